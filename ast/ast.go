@@ -6,6 +6,8 @@ import (
 
 type Node interface {
 	Accept(Visitor)
+	Pos() token.Pos // position of the first character of the node
+	End() token.Pos // position of the first character after the node
 }
 
 type Expr interface {
@@ -23,10 +25,43 @@ type Decl interface {
 	declNode()
 }
 
+// File is the result of parsing a single script.
+type File struct {
+	Name     string
+	Stmts    []Stmt
+	Comments []*Comment // in the order of the source
+}
+
+// Comment is a // comment, which runs to the end of its line.
+type Comment struct {
+	Slash token.Pos
+	Text  string // with the //
+}
+
+func (c *Comment) Pos() token.Pos { return c.Slash }
+func (c *Comment) End() token.Pos { return token.Pos(int(c.Slash) + len(c.Text)) }
+
 // Expression
+
+// BadExpr is a placeholder for an expression that failed to parse.
+type BadExpr struct {
+	From token.Pos
+	To   token.Pos
+}
+
 type Ident struct {
 	NamePos token.Pos
 	Name    string
+	Ref     *Ref // set by the resolver, nil for a global
+}
+
+// Ref is where a variable lives, seen from the function using it.
+// Depth 0 is a local of the function and Slot its index. A variable
+// Depth functions out is reached through upvalue Slot of the
+// function.
+type Ref struct {
+	Depth int
+	Slot  int
 }
 
 type BasicLit struct {
@@ -88,6 +123,7 @@ type ArrayExpr struct {
 }
 
 type SetExpr struct {
+	Hash   token.Pos
 	Lbrack token.Pos
 	Elems  []Expr
 	Rbrack token.Pos
@@ -100,6 +136,7 @@ type Field struct {
 }
 
 type DictExpr struct {
+	Hash   token.Pos
 	Lbrace token.Pos
 	Fields []*Field
 	Rbrace token.Pos
@@ -113,9 +150,45 @@ type FuncDeclExpr struct {
 	Args     []*Ident
 	Body     *BlockStmt
 
-	LocalNames []string
-}
-
+	// set by the resolver
+	Locals   []string // parameters first
+	Captured []bool   // locals that closures refer to
+	Upvals   []*Ident // outer variables, Ref seen from the enclosing function
+}
+
+func (n *BadExpr) Pos() token.Pos      { return n.From }
+func (n *Ident) Pos() token.Pos        { return n.NamePos }
+func (n *BasicLit) Pos() token.Pos     { return n.ValuePos }
+func (n *ParenExpr) Pos() token.Pos    { return n.Lparen }
+func (n *SelectorExpr) Pos() token.Pos { return n.X.Pos() }
+func (n *IndexExpr) Pos() token.Pos    { return n.X.Pos() }
+func (n *SliceExpr) Pos() token.Pos    { return n.X.Pos() }
+func (n *CallExpr) Pos() token.Pos     { return n.Fun.Pos() }
+func (n *UnaryExpr) Pos() token.Pos    { return n.OpPos }
+func (n *BinaryExpr) Pos() token.Pos   { return n.X.Pos() }
+func (n *ArrayExpr) Pos() token.Pos    { return n.Lbrack }
+func (n *SetExpr) Pos() token.Pos      { return n.Hash }
+func (n *Field) Pos() token.Pos        { return n.Name.Pos() }
+func (n *DictExpr) Pos() token.Pos     { return n.Hash }
+func (n *FuncDeclExpr) Pos() token.Pos { return n.Func }
+
+func (n *BadExpr) End() token.Pos      { return n.To }
+func (n *Ident) End() token.Pos        { return token.Pos(int(n.NamePos) + len(n.Name)) }
+func (n *BasicLit) End() token.Pos     { return token.Pos(int(n.ValuePos) + len(n.Value)) }
+func (n *ParenExpr) End() token.Pos    { return n.Rparen + 1 }
+func (n *SelectorExpr) End() token.Pos { return n.Sel.End() }
+func (n *IndexExpr) End() token.Pos    { return n.Rbrack + 1 }
+func (n *SliceExpr) End() token.Pos    { return n.Rbrack + 1 }
+func (n *CallExpr) End() token.Pos     { return n.Rparen + 1 }
+func (n *UnaryExpr) End() token.Pos    { return n.X.End() }
+func (n *BinaryExpr) End() token.Pos   { return n.Y.End() }
+func (n *ArrayExpr) End() token.Pos    { return n.Rbrack + 1 }
+func (n *SetExpr) End() token.Pos      { return n.Rbrack + 1 }
+func (n *Field) End() token.Pos        { return n.Value.End() }
+func (n *DictExpr) End() token.Pos     { return n.Rbrace + 1 }
+func (n *FuncDeclExpr) End() token.Pos { return n.Body.End() }
+
+func (BadExpr) exprNode()      {}
 func (Ident) exprNode()        {}
 func (BasicLit) exprNode()     {}
 func (ParenExpr) exprNode()    {}
@@ -130,6 +203,10 @@ func (SetExpr) exprNode()      {}
 func (DictExpr) exprNode()     {}
 func (FuncDeclExpr) exprNode() {}
 
+func (n *BadExpr) Accept(v Visitor) {
+	v.VisitBadExpr(n)
+}
+
 func (n *Ident) Accept(v Visitor) {
 	v.VisitIdent(n)
 }
@@ -184,6 +261,12 @@ func (n *FuncDeclExpr) Accept(v Visitor) {
 
 /// Stmts
 
+// BadStmt is a placeholder for a statement that failed to parse.
+type BadStmt struct {
+	From token.Pos
+	To   token.Pos
+}
+
 type ExprStmt struct {
 	X Expr
 }
@@ -207,6 +290,20 @@ type AssignStmt struct {
 	Rhs    []Expr
 }
 
+// DeclStmt is var x, y = a, b or const x = a. Values is empty for a
+// var without values.
+type DeclStmt struct {
+	TokPos token.Pos
+	Tok    token.Token // VAR or CONST
+	Names  []*Ident
+	Values []Expr
+}
+
+type DeferStmt struct {
+	Defer token.Pos
+	Call  *CallExpr
+}
+
 type GoStmt struct {
 	Go   token.Pos
 	Call *CallExpr
@@ -264,14 +361,105 @@ type ForStmt struct {
 type RangeStmt struct {
 	For      token.Pos
 	KeyValue []Expr
+	Tok      token.Token // ASSIGN or DEFINE
 	X        Expr
 	Body     *BlockStmt
 }
 
+// TryStmt is try { } catch err { } finally { }. Err may be nil, and
+// one of Handler and Finally may be nil.
+type TryStmt struct {
+	Try     token.Pos
+	Body    *BlockStmt
+	Catch   token.Pos
+	Err     *Ident
+	Handler *BlockStmt
+	Finally *BlockStmt
+}
+
+func (n *BadStmt) Pos() token.Pos    { return n.From }
+func (n *ExprStmt) Pos() token.Pos   { return n.X.Pos() }
+func (n *SendStmt) Pos() token.Pos   { return n.Chan.Pos() }
+func (n *IncDecStmt) Pos() token.Pos { return n.X.Pos() }
+func (n *AssignStmt) Pos() token.Pos {
+	if len(n.Lhs) > 0 {
+		return n.Lhs[0].Pos()
+	}
+	return n.TokPos
+}
+func (n *DeclStmt) Pos() token.Pos   { return n.TokPos }
+func (n *DeferStmt) Pos() token.Pos  { return n.Defer }
+func (n *GoStmt) Pos() token.Pos     { return n.Go }
+func (n *ReturnStmt) Pos() token.Pos { return n.Return }
+func (n *BranchStmt) Pos() token.Pos { return n.TokPos }
+func (n *BlockStmt) Pos() token.Pos  { return n.Lbrace }
+func (n *IfStmt) Pos() token.Pos     { return n.If }
+func (n *CaseClause) Pos() token.Pos { return n.Case }
+func (n *SwitchStmt) Pos() token.Pos { return n.Switch }
+func (n *SelectStmt) Pos() token.Pos { return n.Select }
+func (n *ForStmt) Pos() token.Pos    { return n.For }
+func (n *RangeStmt) Pos() token.Pos  { return n.For }
+func (n *TryStmt) Pos() token.Pos    { return n.Try }
+
+func (n *BadStmt) End() token.Pos    { return n.To }
+func (n *ExprStmt) End() token.Pos   { return n.X.End() }
+func (n *SendStmt) End() token.Pos   { return n.Value.End() }
+func (n *IncDecStmt) End() token.Pos { return n.TokPos + 2 }
+func (n *AssignStmt) End() token.Pos {
+	if len(n.Rhs) > 0 {
+		return n.Rhs[len(n.Rhs)-1].End()
+	}
+	return token.Pos(int(n.TokPos) + len(token.Tokens[n.Tok]))
+}
+func (n *DeclStmt) End() token.Pos {
+	if len(n.Values) > 0 {
+		return n.Values[len(n.Values)-1].End()
+	}
+	return n.Names[len(n.Names)-1].End()
+}
+func (n *DeferStmt) End() token.Pos { return n.Call.End() }
+func (n *GoStmt) End() token.Pos    { return n.Call.End() }
+func (n *ReturnStmt) End() token.Pos {
+	if len(n.Results) > 0 {
+		return n.Results[len(n.Results)-1].End()
+	}
+	return n.Return + 6 // len("return")
+}
+func (n *BranchStmt) End() token.Pos {
+	return token.Pos(int(n.TokPos) + len(token.Tokens[n.Tok]))
+}
+func (n *BlockStmt) End() token.Pos { return n.Rbrack + 1 }
+func (n *IfStmt) End() token.Pos {
+	if n.Else != nil {
+		return n.Else.End()
+	}
+	return n.Body.End()
+}
+func (n *CaseClause) End() token.Pos {
+	if len(n.Body) > 0 {
+		return n.Body[len(n.Body)-1].End()
+	}
+	return n.Colon + 1
+}
+func (n *SwitchStmt) End() token.Pos { return n.Body.End() }
+func (n *SelectStmt) End() token.Pos { return n.Body.End() }
+func (n *ForStmt) End() token.Pos    { return n.Body.End() }
+func (n *RangeStmt) End() token.Pos  { return n.Body.End() }
+func (n *TryStmt) End() token.Pos {
+	if n.Finally != nil {
+		return n.Finally.End()
+	}
+	return n.Handler.End()
+}
+
+func (BadStmt) stmtNode()    {}
+func (TryStmt) stmtNode()    {}
 func (ExprStmt) stmtNode()   {}
 func (SendStmt) stmtNode()   {}
 func (IncDecStmt) stmtNode() {}
 func (AssignStmt) stmtNode() {}
+func (DeclStmt) stmtNode()   {}
+func (DeferStmt) stmtNode()  {}
 func (GoStmt) stmtNode()     {}
 func (ReturnStmt) stmtNode() {}
 func (BranchStmt) stmtNode() {}
@@ -283,6 +471,10 @@ func (SelectStmt) stmtNode() {}
 func (ForStmt) stmtNode()    {}
 func (RangeStmt) stmtNode()  {}
 
+func (n *BadStmt) Accept(v Visitor) {
+	v.VisitBadStmt(n)
+}
+
 func (n *ExprStmt) Accept(v Visitor) {
 	v.VisitExprStmt(n)
 }
@@ -299,6 +491,14 @@ func (n *AssignStmt) Accept(v Visitor) {
 	v.VisitAssignStmt(n)
 }
 
+func (n *DeclStmt) Accept(v Visitor) {
+	v.VisitDeclStmt(n)
+}
+
+func (n *DeferStmt) Accept(v Visitor) {
+	v.VisitDeferStmt(n)
+}
+
 func (n *GoStmt) Accept(v Visitor) {
 	v.VisitGoStmt(n)
 }
@@ -338,3 +538,7 @@ func (n *ForStmt) Accept(v Visitor) {
 func (n *RangeStmt) Accept(v Visitor) {
 	v.VisitRangeStmt(n)
 }
+
+func (n *TryStmt) Accept(v Visitor) {
+	v.VisitTryStmt(n)
+}
@@ -0,0 +1,70 @@
+package ast
+
+import (
+	"reflect"
+
+	"github.com/jxwr/doubi/token"
+)
+
+var (
+	posType = reflect.TypeOf(token.NoPos)
+	refType = reflect.TypeOf(&Ref{})
+)
+
+// Equal reports whether two trees are the same, apart from positions
+// and what the resolver added. doubi fmt uses it to make sure the
+// layout it writes parses back to the tree it read.
+func Equal(x, y interface{}) bool {
+	return equal(reflect.ValueOf(x), reflect.ValueOf(y))
+}
+
+func equal(x, y reflect.Value) bool {
+	if x.IsValid() != y.IsValid() {
+		return false
+	}
+	if !x.IsValid() {
+		return true
+	}
+	if x.Type() != y.Type() {
+		return false
+	}
+
+	switch x.Type() {
+	case posType, refType:
+		return true
+	}
+
+	switch x.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if x.IsNil() || y.IsNil() {
+			return x.IsNil() == y.IsNil()
+		}
+		return equal(x.Elem(), y.Elem())
+	case reflect.Slice:
+		if x.Len() != y.Len() {
+			return false
+		}
+		for i := 0; i < x.Len(); i++ {
+			if !equal(x.Index(i), y.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if x.Type() == reflect.TypeOf(FuncDeclExpr{}) {
+			// only compare what the parser sets
+			return equal(x.FieldByName("Recv"), y.FieldByName("Recv")) &&
+				equal(x.FieldByName("RecvType"), y.FieldByName("RecvType")) &&
+				equal(x.FieldByName("Name"), y.FieldByName("Name")) &&
+				equal(x.FieldByName("Args"), y.FieldByName("Args")) &&
+				equal(x.FieldByName("Body"), y.FieldByName("Body"))
+		}
+		for i := 0; i < x.NumField(); i++ {
+			if !equal(x.Field(i), y.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return x.Interface() == y.Interface()
+}
@@ -1,6 +1,7 @@
 package ast
 
 type Visitor interface {
+	VisitBadExpr(node *BadExpr)
 	VisitIdent(node *Ident)
 	VisitBasicLit(node *BasicLit)
 	VisitParenExpr(node *ParenExpr)
@@ -14,10 +15,13 @@ type Visitor interface {
 	VisitSetExpr(node *SetExpr)
 	VisitDictExpr(node *DictExpr)
 	VisitFuncDeclExpr(node *FuncDeclExpr)
+	VisitBadStmt(node *BadStmt)
 	VisitExprStmt(node *ExprStmt)
 	VisitSendStmt(node *SendStmt)
 	VisitIncDecStmt(node *IncDecStmt)
 	VisitAssignStmt(node *AssignStmt)
+	VisitDeclStmt(node *DeclStmt)
+	VisitDeferStmt(node *DeferStmt)
 	VisitGoStmt(node *GoStmt)
 	VisitReturnStmt(node *ReturnStmt)
 	VisitBranchStmt(node *BranchStmt)
@@ -28,4 +32,5 @@ type Visitor interface {
 	VisitSelectStmt(node *SelectStmt)
 	VisitForStmt(node *ForStmt)
 	VisitRangeStmt(node *RangeStmt)
+	VisitTryStmt(node *TryStmt)
 }
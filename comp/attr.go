@@ -5,20 +5,106 @@ import (
 	"reflect"
 
 	"github.com/jxwr/doubi/ast"
-	"github.com/jxwr/doubi/env"
+	"github.com/jxwr/doubi/parser"
 	"github.com/jxwr/doubi/rt"
 	"github.com/jxwr/doubi/token"
 )
 
+// Attr resolves the variables of a script before it runs. Every
+// ast.Ident gets the Ref of the variable it names, and every
+// function the list of its locals and of the outer variables it
+// uses.
+//
+// x := a, var x = a and const x = a declare x in the current block,
+// hiding any x outside it until the block ends. Declared at the top
+// level outside any block, x is a global. A constant cannot be
+// assigned again. Assigning with = to a name that is not visible
+// creates it as before: a global at the top level and a local of the
+// function elsewhere. This is reported as a warning, and in Strict
+// mode as an error. The key and value of a range are declared in the
+// loop. The mistakes found are kept in Diagnostics.
+//
+// Closures capture variables, not values: a closure and the function
+// it was made in share the variable, and see each other's
+// assignments. Every iteration of a range has its own key and value,
+// and every run of a declaration makes a new variable, so closures
+// made in different iterations see different variables.
 type Attr struct {
-	Debug bool
-	E     *env.Env
-	Fun   *ast.FuncDeclExpr
+	Debug   bool
+	Strict  bool
+	Globals map[string]bool
+	Fset    *token.FileSet
+
+	Diagnostics []*Diagnostic
+
+	consts map[string]bool // global constants
+	fs     *funcScope
+}
+
+// funcScope is the function being resolved.
+type funcScope struct {
+	outer  *funcScope
+	fun    *ast.FuncDeclExpr
+	slots  map[string]int // the visible locals
+	consts map[int]bool   // the slots of constants
+	upvals map[string]int
+	block  *blockScope
+}
+
+// blockScope is the block being resolved.
+type blockScope struct {
+	outer  *blockScope
+	names  map[string]bool // declared in the block
+	hidden map[string]int  // the slots the declarations hide, -1 for none
+}
+
+func NewAttr(fset *token.FileSet) *Attr {
+	return &Attr{false, false, map[string]bool{}, fset, nil, map[string]bool{}, nil}
+}
+
+// Script resolves the statements of a script and returns them as the
+// body of the top level function, which holds the locals of the top
+// level, such as the variables of a range. The diagnostics that are
+// errors are returned as a parser.ErrorList.
+func (self *Attr) Script(stmts []ast.Stmt) (*ast.FuncDeclExpr, error) {
+	main := &ast.FuncDeclExpr{Body: &ast.BlockStmt{List: stmts}}
+	self.Diagnostics = nil
+	self.fs = newFuncScope(nil, main)
+	self.openBlock()
+	for _, stmt := range stmts {
+		stmt.Accept(self)
+	}
+	self.closeBlock()
+	self.fs = nil
+
+	errs := parser.ErrorList{}
+	for _, diag := range self.Diagnostics {
+		if diag.Severity == Error {
+			errs = append(errs, diag)
+		}
+	}
+	if len(errs) > 0 {
+		return main, errs
+	}
+	return main, nil
+}
+
+func newFuncScope(outer *funcScope, fun *ast.FuncDeclExpr) *funcScope {
+	return &funcScope{outer, fun, map[string]int{}, map[int]bool{}, map[string]int{}, nil}
+}
+
+func (self *Attr) isTop() bool {
+	return self.fs.outer == nil
+}
+
+// isGlobalBlock reports whether declarations make globals.
+func (self *Attr) isGlobalBlock() bool {
+	return self.isTop() && self.fs.block.outer == nil
 }
 
-func (self *Attr) log(fmtstr string, args ...interface{}) {
-	fmt.Printf(fmtstr, args...)
-	fmt.Println()
+func (self *Attr) report(pos token.Pos, severity Severity, code string, format string, args ...interface{}) {
+	diag := &Diagnostic{self.Fset.Position(pos), severity, code, fmt.Sprintf(format, args...)}
+	self.Diagnostics = append(self.Diagnostics, diag)
 }
 
 func (self *Attr) debug(node interface{}) {
@@ -28,39 +114,203 @@ func (self *Attr) debug(node interface{}) {
 }
 
 func (self *Attr) checkIdentRef(node ast.Expr) {
-	switch arg := node.(type) {
-	case *ast.Ident:
-		_, builtin := rt.Builtins[arg.Name]
-
-		keyword := false
-		for i := token.BREAK; i <= token.VAR; i++ {
-			if token.Tokens[i] == arg.Name {
-				keyword = true
-			}
+	node.Accept(self)
+}
+
+func (self *Attr) checkIdentListRef(nodes []ast.Expr) {
+	for _, node := range nodes {
+		self.checkIdentRef(node)
+	}
+}
+
+/// resolution
+
+func (self *Attr) declare(name string) int {
+	fun := self.fs.fun
+	slot := len(fun.Locals)
+	fun.Locals = append(fun.Locals, name)
+	fun.Captured = append(fun.Captured, false)
+	self.fs.slots[name] = slot
+	return slot
+}
+
+func (self *Attr) openBlock() {
+	self.fs.block = &blockScope{self.fs.block, map[string]bool{}, map[string]int{}}
+}
+
+// closeBlock ends the block, making visible again the variables its
+// declarations hid.
+func (self *Attr) closeBlock() {
+	block := self.fs.block
+	for name, slot := range block.hidden {
+		if slot < 0 {
+			delete(self.fs.slots, name)
+		} else {
+			self.fs.slots[name] = slot
 		}
-		_, env := self.E.LookUp(arg.Name)
-		if arg.Name != "_" && env == nil && !builtin && !keyword {
-			self.log("'%s' not found", arg.Name)
+	}
+	self.fs.block = block.outer
+}
+
+// define declares node as a new variable of the current block.
+func (self *Attr) define(node *ast.Ident, isConst bool) {
+	self.debug(node)
+
+	name := node.Name
+	if name == "_" {
+		return
+	}
+	block := self.fs.block
+	if block.names[name] {
+		self.report(node.NamePos, Error, "redeclared", "%s redeclared in this block", name)
+	}
+	block.names[name] = true
+
+	if self.isGlobalBlock() {
+		self.Globals[name] = true
+		self.consts[name] = isConst
+		node.Ref = nil
+		return
+	}
+	if _, ok := block.hidden[name]; !ok {
+		if slot, ok := self.fs.slots[name]; ok {
+			block.hidden[name] = slot
+		} else {
+			block.hidden[name] = -1
 		}
-	default:
-		arg.Accept(self)
 	}
+	slot := self.declare(name)
+	if isConst {
+		self.fs.consts[slot] = true
+	}
+	node.Ref = &ast.Ref{0, slot}
 }
 
-func (self *Attr) checkIdentListRef(nodes []ast.Expr) {
-	for _, node := range nodes {
+// resolve finds the variable name refers to, nil for a global.
+func (self *Attr) resolve(name string) *ast.Ref {
+	if slot, ok := self.fs.slots[name]; ok {
+		return &ast.Ref{0, slot}
+	}
+	return self.upval(self.fs, name)
+}
+
+// upval finds name in the functions enclosing fs and returns the
+// Ref of fs to it, or nil.
+func (self *Attr) upval(fs *funcScope, name string) *ast.Ref {
+	if idx, ok := fs.upvals[name]; ok {
+		return &ast.Ref{fs.fun.Upvals[idx].Ref.Depth + 1, idx}
+	}
+	outer := fs.outer
+	if outer == nil {
+		return nil
+	}
+
+	var ref *ast.Ref
+	if slot, ok := outer.slots[name]; ok {
+		outer.fun.Captured[slot] = true
+		ref = &ast.Ref{0, slot}
+	} else if ref = self.upval(outer, name); ref == nil {
+		return nil
+	}
+
+	fs.fun.Upvals = append(fs.fun.Upvals, &ast.Ident{token.NoPos, name, ref})
+	fs.upvals[name] = len(fs.fun.Upvals) - 1
+	return &ast.Ref{ref.Depth + 1, fs.upvals[name]}
+}
+
+// isConst reports whether the variable name refers to is a constant.
+func (self *Attr) isConst(name string) bool {
+	for fs := self.fs; fs != nil; fs = fs.outer {
+		if slot, ok := fs.slots[name]; ok {
+			return fs.consts[slot]
+		}
+	}
+	return self.consts[name]
+}
+
+// checkAssign reports an assignment to a constant.
+func (self *Attr) checkAssign(node ast.Expr) {
+	if ident, ok := node.(*ast.Ident); ok && self.isConst(ident.Name) {
+		self.report(ident.NamePos, Error, "const-assign", "cannot assign to constant %s", ident.Name)
+	}
+}
+
+// bind resolves a name that is assigned or declared without var. A
+// name that is not visible yet becomes a global at the top level and
+// a local of the current function elsewhere.
+func (self *Attr) bind(node *ast.Ident) {
+	self.debug(node)
+
+	name := node.Name
+	if name == "_" {
+		return
+	}
+	node.Ref = self.resolve(name)
+	if node.Ref != nil {
+		return
+	}
+	if self.isTop() {
+		self.Globals[name] = true
+	} else if !self.Globals[name] {
+		node.Ref = &ast.Ref{0, self.declare(name)}
+	}
+}
+
+// store resolves a name assigned with =.
+func (self *Attr) store(node *ast.Ident) {
+	if node.Name == "_" {
+		return
+	}
+	self.checkAssign(node)
+	if !self.Globals[node.Name] && self.resolve(node.Name) == nil {
+		severity := Warning
+		if self.Strict {
+			severity = Error
+		}
+		self.report(node.NamePos, severity, "undeclared", "assignment to undeclared variable %s", node.Name)
+	}
+	self.bind(node)
+}
+
+func (self *Attr) storeTarget(node ast.Expr) {
+	if ident, ok := node.(*ast.Ident); ok {
+		self.store(ident)
+	} else {
 		self.checkIdentRef(node)
 	}
 }
 
 // exprs
 
+func (self *Attr) VisitBadExpr(node *ast.BadExpr) {
+	self.debug(node)
+}
+
 func (self *Attr) VisitIdent(node *ast.Ident) {
 	self.debug(node)
+
+	switch node.Name {
+	case "_", "true", "false", "nil":
+		return
+	}
+	// names that are not found are globals, which the Checker
+	// looks for once the whole script is resolved
+	node.Ref = self.resolve(node.Name)
 }
 
 func (self *Attr) VisitBasicLit(node *ast.BasicLit) {
 	self.debug(node)
+
+	if _, err := rt.ParseLit(node.Kind, node.Value); err != nil {
+		code := "bad-number"
+		switch node.Kind {
+		case token.STRING:
+			code = "bad-string"
+		case token.CHAR:
+			code = "bad-rune"
+		}
+		self.report(node.ValuePos, Error, code, "%v", err)
+	}
 }
 
 func (self *Attr) VisitParenExpr(node *ast.ParenExpr) {
@@ -138,24 +388,32 @@ func (self *Attr) VisitDictExpr(node *ast.DictExpr) {
 func (self *Attr) VisitFuncDeclExpr(node *ast.FuncDeclExpr) {
 	self.debug(node)
 
+	// the name is bound before the body, which may call itself
 	if node.Name != nil {
-		self.E.Put(node.Name.Name, node.Name)
+		if !self.isTop() {
+			if _, ok := self.fs.slots[node.Name.Name]; !ok {
+				self.declare(node.Name.Name)
+			}
+		}
+		self.checkAssign(node.Name)
+		self.bind(node.Name)
 	}
 
-	self.Enter()
+	node.Locals, node.Captured, node.Upvals = nil, nil, nil
+	self.fs = newFuncScope(self.fs, node)
 	for _, arg := range node.Args {
-		self.E.Put(arg.Name, arg)
+		arg.Ref = &ast.Ref{0, self.declare(arg.Name)}
 	}
-
-	fnBak := self.Fun
-	self.Fun = node
 	node.Body.Accept(self)
-	self.Fun = fnBak
-	self.Leave()
+	self.fs = self.fs.outer
 }
 
 // stmts
 
+func (self *Attr) VisitBadStmt(node *ast.BadStmt) {
+	self.debug(node)
+}
+
 func (self *Attr) VisitExprStmt(node *ast.ExprStmt) {
 	self.debug(node)
 
@@ -173,40 +431,51 @@ func (self *Attr) VisitIncDecStmt(node *ast.IncDecStmt) {
 	self.debug(node)
 
 	self.checkIdentRef(node.X)
+	self.checkAssign(node.X)
 }
 
 func (self *Attr) VisitAssignStmt(node *ast.AssignStmt) {
 	self.debug(node)
 
-	if node.Tok != token.ASSIGN {
-		for _, arg := range node.Lhs {
-			self.checkIdentRef(arg)
+	// the values are evaluated before anything is assigned
+	self.checkIdentListRef(node.Rhs)
+
+	switch node.Tok {
+	case token.ASSIGN:
+		for _, lhs := range node.Lhs {
+			self.storeTarget(lhs)
 		}
-	} else {
-		for _, arg := range node.Lhs {
-			if ident, ok := arg.(*ast.Ident); ok {
-				val, _ := self.E.LookUp(ident.Name)
-				// set lexical variable
-				if val == nil && self.Fun != nil {
-					self.Fun.LocalNames = append(self.Fun.LocalNames, ident.Name)
-				}
-				self.E.Put(ident.Name, ident)
+	case token.DEFINE:
+		for _, lhs := range node.Lhs {
+			if ident, ok := lhs.(*ast.Ident); ok {
+				self.define(ident, false)
+			} else {
+				self.report(lhs.Pos(), Error, "bad-define", "non-name on left side of :=")
 			}
 		}
+	default:
+		self.checkIdentListRef(node.Lhs)
+		for _, lhs := range node.Lhs {
+			self.checkAssign(lhs)
+		}
 	}
+}
 
-	for _, arg := range node.Rhs {
-		self.checkIdentRef(arg)
-	}
+func (self *Attr) VisitDeclStmt(node *ast.DeclStmt) {
+	self.debug(node)
 
-	for _, lh := range node.Lhs {
-		lh, ok := lh.(*ast.Ident)
-		if ok {
-			self.E.Put(lh.Name, lh)
-		}
+	self.checkIdentListRef(node.Values)
+	for _, name := range node.Names {
+		self.define(name, node.Tok == token.CONST)
 	}
 }
 
+func (self *Attr) VisitDeferStmt(node *ast.DeferStmt) {
+	self.debug(node)
+
+	node.Call.Accept(self)
+}
+
 func (self *Attr) VisitGoStmt(node *ast.GoStmt) {
 	self.debug(node)
 
@@ -226,9 +495,11 @@ func (self *Attr) VisitBranchStmt(node *ast.BranchStmt) {
 func (self *Attr) VisitBlockStmt(node *ast.BlockStmt) {
 	self.debug(node)
 
+	self.openBlock()
 	for _, stmt := range node.List {
 		stmt.Accept(self)
 	}
+	self.closeBlock()
 }
 
 func (self *Attr) VisitIfStmt(node *ast.IfStmt) {
@@ -245,16 +516,21 @@ func (self *Attr) VisitCaseClause(node *ast.CaseClause) {
 	self.debug(node)
 
 	self.checkIdentListRef(node.List)
+	self.openBlock()
 	for _, stmt := range node.Body {
 		stmt.Accept(self)
 	}
+	self.closeBlock()
 }
 
 func (self *Attr) VisitSwitchStmt(node *ast.SwitchStmt) {
 	self.debug(node)
 
+	// the variables declared by the init belong to the switch
+	self.openBlock()
 	node.Init.Accept(self)
 	node.Body.Accept(self)
+	self.closeBlock()
 }
 
 func (self *Attr) VisitSelectStmt(node *ast.SelectStmt) {
@@ -266,32 +542,51 @@ func (self *Attr) VisitSelectStmt(node *ast.SelectStmt) {
 func (self *Attr) VisitForStmt(node *ast.ForStmt) {
 	self.debug(node)
 
+	// the variables declared by the init belong to the loop
+	self.openBlock()
 	if node.Init != nil {
 		node.Init.Accept(self)
 	}
 	self.checkIdentRef(node.Cond)
 	node.Body.Accept(self)
+	if node.Post != nil {
+		node.Post.Accept(self)
+	}
+	self.closeBlock()
 }
 
 func (self *Attr) VisitRangeStmt(node *ast.RangeStmt) {
 	self.debug(node)
 
-	key := node.KeyValue[0].(*ast.Ident)
-	self.E.Put(key.Name, key)
-
-	val := node.KeyValue[1].(*ast.Ident)
-	self.E.Put(val.Name, val)
-
 	self.checkIdentRef(node.X)
-	self.Enter()
+
+	// the key and value are new variables of the loop, hiding the
+	// variables of the same names until it ends
+	self.openBlock()
+	for _, kv := range node.KeyValue {
+		ident, ok := kv.(*ast.Ident)
+		if !ok || ident.Name == "_" {
+			self.storeTarget(kv)
+			continue
+		}
+		self.define(ident, false)
+	}
 	node.Body.Accept(self)
-	self.Leave()
+	self.closeBlock()
 }
 
-func (self *Attr) Enter() {
-	self.E = env.NewEnv(self.E)
-}
+func (self *Attr) VisitTryStmt(node *ast.TryStmt) {
+	self.debug(node)
 
-func (self *Attr) Leave() {
-	self.E = self.E.Outer
+	node.Body.Accept(self)
+	if node.Handler != nil {
+		if node.Err != nil {
+			self.checkAssign(node.Err)
+			self.bind(node.Err)
+		}
+		node.Handler.Accept(self)
+	}
+	if node.Finally != nil {
+		node.Finally.Accept(self)
+	}
 }
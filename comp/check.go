@@ -0,0 +1,511 @@
+package comp
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jxwr/doubi/ast"
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// Checker looks for mistakes in a script without running it. Besides
+// what Attr reports, it finds undefined names, unused variables and
+// parameters, code after a return, break or continue, calls with the
+// wrong number of arguments to functions it knows, and break or
+// continue outside a loop.
+type Checker struct {
+	Debug  bool
+	Strict bool
+	Fset   *token.FileSet
+
+	attr  *Attr
+	diags []*Diagnostic
+	funcs []*ast.FuncDeclExpr // the functions being checked, innermost last
+	loops int                 // loops of the innermost function around the code
+	vars  map[varKey]*varInfo
+	order []varKey // the variables in the order they were seen
+	calls []callSite
+}
+
+// varKey is a variable: a slot of a function, or a global.
+type varKey struct {
+	fun  *ast.FuncDeclExpr
+	slot int
+	name string
+}
+
+type varInfo struct {
+	ident  *ast.Ident // where it is first seen
+	param  bool
+	reads  int
+	writes int
+	fun    *ast.FuncDeclExpr // the function it is set to, if any
+}
+
+// callSite is a call of the function in a variable.
+type callSite struct {
+	key  varKey
+	node *ast.CallExpr
+}
+
+func NewChecker(fset *token.FileSet) *Checker {
+	return &Checker{false, false, fset, nil, nil, nil, 0, nil, nil, nil}
+}
+
+// Check resolves and checks the statements of a script, and returns
+// what it found ordered by position.
+func (self *Checker) Check(stmts []ast.Stmt) []*Diagnostic {
+	self.attr = NewAttr(self.Fset)
+	self.attr.Strict = self.Strict
+	script, _ := self.attr.Script(stmts)
+
+	self.diags = append([]*Diagnostic{}, self.attr.Diagnostics...)
+	self.funcs = []*ast.FuncDeclExpr{script}
+	self.loops = 0
+	self.vars = map[varKey]*varInfo{}
+	self.order = nil
+	self.calls = nil
+
+	// a top level return only leaves its statement, so the next one
+	// is reachable
+	for _, stmt := range stmts {
+		stmt.Accept(self)
+	}
+	self.unused()
+	self.arity()
+
+	SortDiagnostics(self.diags)
+	return self.diags
+}
+
+func (self *Checker) report(pos token.Pos, severity Severity, code string, format string, args ...interface{}) {
+	diag := &Diagnostic{self.Fset.Position(pos), severity, code, fmt.Sprintf(format, args...)}
+	self.diags = append(self.diags, diag)
+}
+
+func (self *Checker) debug(node interface{}) {
+	if self.Debug {
+		fmt.Printf("%s(%#v)\n", reflect.TypeOf(node).Name(), node)
+	}
+}
+
+/// variables
+
+// key finds the variable node refers to, following the upvalues of
+// the functions being checked.
+func (self *Checker) key(node *ast.Ident) varKey {
+	ref := node.Ref
+	if ref == nil {
+		return varKey{nil, 0, node.Name}
+	}
+	i := len(self.funcs) - 1
+	for ref.Depth > 0 {
+		ref = self.funcs[i].Upvals[ref.Slot].Ref
+		i--
+	}
+	return varKey{self.funcs[i], ref.Slot, ""}
+}
+
+func (self *Checker) info(node *ast.Ident) *varInfo {
+	key := self.key(node)
+	info, ok := self.vars[key]
+	if !ok {
+		info = &varInfo{node, false, 0, 0, nil}
+		self.vars[key] = info
+		self.order = append(self.order, key)
+	}
+	return info
+}
+
+// defined reports whether a name that is not a variable of a
+// function is known when the script runs.
+func (self *Checker) defined(node *ast.Ident) bool {
+	switch node.Name {
+	case "true", "false", "nil":
+		return true
+	}
+	_, builtin := rt.Builtins[node.Name]
+	return builtin || self.attr.Globals[node.Name]
+}
+
+func (self *Checker) read(node *ast.Ident) {
+	if node.Name == "_" {
+		return
+	}
+	if node.Ref == nil && !self.defined(node) {
+		self.report(node.NamePos, Error, "undefined", "undefined: %s", node.Name)
+		return
+	}
+	self.info(node).reads++
+}
+
+// write records an assignment of value, which may be nil, to node.
+func (self *Checker) write(node *ast.Ident, value ast.Expr) {
+	if node.Name == "_" {
+		return
+	}
+	info := self.info(node)
+	info.writes++
+	info.fun, _ = value.(*ast.FuncDeclExpr)
+}
+
+func (self *Checker) writeTarget(node ast.Expr, value ast.Expr) {
+	if ident, ok := node.(*ast.Ident); ok {
+		self.write(ident, value)
+	} else {
+		node.Accept(self)
+	}
+}
+
+// unused reports the locals and parameters that are never read.
+// Globals may be read by scripts run later, as in the repl.
+func (self *Checker) unused() {
+	for _, key := range self.order {
+		info := self.vars[key]
+		if key.fun == nil || info.reads > 0 {
+			continue
+		}
+		if info.param {
+			self.report(info.ident.NamePos, Warning, "unused-param", "parameter %s is not used", info.ident.Name)
+		} else {
+			self.report(info.ident.NamePos, Warning, "unused-var", "%s declared and not used", info.ident.Name)
+		}
+	}
+}
+
+// arity checks the calls of variables that are only ever set to one
+// function.
+func (self *Checker) arity() {
+	for _, call := range self.calls {
+		info, ok := self.vars[call.key]
+		if !ok || info.writes != 1 || info.fun == nil || info.fun.Recv != nil {
+			continue
+		}
+		args := call.node.Args
+		if len(args) == 1 {
+			// f(g()) passes all the results of g
+			if _, ok := args[0].(*ast.CallExpr); ok {
+				continue
+			}
+		}
+		if len(args) != len(info.fun.Args) {
+			self.report(call.node.Lparen, Error, "arg-count", "%s expects %d argument(s), got %d",
+				call.node.Fun.(*ast.Ident).Name, len(info.fun.Args), len(args))
+		}
+	}
+}
+
+// call records a call, to be checked once every function is known.
+func (self *Checker) call(node *ast.CallExpr) {
+	if ident, ok := node.Fun.(*ast.Ident); ok && ident.Name != "_" {
+		self.calls = append(self.calls, callSite{self.key(ident), node})
+	}
+}
+
+/// stmts
+
+// stmts checks a list of statements, reporting the first one that
+// follows a return, break or continue.
+func (self *Checker) stmts(list []ast.Stmt) {
+	for i, stmt := range list {
+		stmt.Accept(self)
+		switch stmt.(type) {
+		case *ast.ReturnStmt, *ast.BranchStmt:
+			if i+1 < len(list) {
+				self.report(list[i+1].Pos(), Warning, "unreachable", "unreachable code")
+				for _, stmt := range list[i+1:] {
+					stmt.Accept(self)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (self *Checker) exprs(list []ast.Expr) {
+	for _, expr := range list {
+		expr.Accept(self)
+	}
+}
+
+// assign records the assignments of values to lhs. A value is only
+// known to go to a variable when there are as many values.
+func (self *Checker) assign(lhs []ast.Expr, values []ast.Expr) {
+	for i, node := range lhs {
+		var value ast.Expr
+		if len(values) == len(lhs) {
+			value = values[i]
+		}
+		self.writeTarget(node, value)
+	}
+}
+
+// exprs
+
+func (self *Checker) VisitBadExpr(node *ast.BadExpr) {
+	self.debug(node)
+}
+
+func (self *Checker) VisitIdent(node *ast.Ident) {
+	self.debug(node)
+
+	self.read(node)
+}
+
+func (self *Checker) VisitBasicLit(node *ast.BasicLit) {
+	self.debug(node)
+}
+
+func (self *Checker) VisitParenExpr(node *ast.ParenExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+}
+
+func (self *Checker) VisitSelectorExpr(node *ast.SelectorExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+}
+
+func (self *Checker) VisitIndexExpr(node *ast.IndexExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+	node.Index.Accept(self)
+}
+
+func (self *Checker) VisitSliceExpr(node *ast.SliceExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+	if node.Low != nil {
+		node.Low.Accept(self)
+	}
+	if node.High != nil {
+		node.High.Accept(self)
+	}
+}
+
+func (self *Checker) VisitCallExpr(node *ast.CallExpr) {
+	self.debug(node)
+
+	node.Fun.Accept(self)
+	self.exprs(node.Args)
+	self.call(node)
+}
+
+func (self *Checker) VisitUnaryExpr(node *ast.UnaryExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+}
+
+func (self *Checker) VisitBinaryExpr(node *ast.BinaryExpr) {
+	self.debug(node)
+
+	node.X.Accept(self)
+	node.Y.Accept(self)
+}
+
+func (self *Checker) VisitArrayExpr(node *ast.ArrayExpr) {
+	self.debug(node)
+
+	self.exprs(node.Elems)
+}
+
+func (self *Checker) VisitSetExpr(node *ast.SetExpr) {
+	self.debug(node)
+
+	self.exprs(node.Elems)
+}
+
+func (self *Checker) VisitDictExpr(node *ast.DictExpr) {
+	self.debug(node)
+
+	for _, field := range node.Fields {
+		field.Name.Accept(self)
+		field.Value.Accept(self)
+	}
+}
+
+func (self *Checker) VisitFuncDeclExpr(node *ast.FuncDeclExpr) {
+	self.debug(node)
+
+	if node.Name != nil {
+		self.write(node.Name, node)
+	}
+
+	self.funcs = append(self.funcs, node)
+	loops := self.loops
+	self.loops = 0
+	for _, arg := range node.Args {
+		if arg.Name != "_" {
+			info := self.info(arg)
+			info.param = true
+			info.writes++
+		}
+	}
+	self.stmts(node.Body.List)
+	self.loops = loops
+	self.funcs = self.funcs[:len(self.funcs)-1]
+}
+
+// stmts
+
+func (self *Checker) VisitBadStmt(node *ast.BadStmt) {
+	self.debug(node)
+}
+
+func (self *Checker) VisitExprStmt(node *ast.ExprStmt) {
+	self.debug(node)
+
+	node.X.Accept(self)
+}
+
+func (self *Checker) VisitSendStmt(node *ast.SendStmt) {
+	self.debug(node)
+
+	node.Chan.Accept(self)
+	node.Value.Accept(self)
+}
+
+func (self *Checker) VisitIncDecStmt(node *ast.IncDecStmt) {
+	self.debug(node)
+
+	node.X.Accept(self)
+}
+
+func (self *Checker) VisitAssignStmt(node *ast.AssignStmt) {
+	self.debug(node)
+
+	self.exprs(node.Rhs)
+	switch node.Tok {
+	case token.ASSIGN, token.DEFINE:
+		self.assign(node.Lhs, node.Rhs)
+	default:
+		// x += y reads x
+		self.exprs(node.Lhs)
+		for _, lhs := range node.Lhs {
+			if ident, ok := lhs.(*ast.Ident); ok {
+				self.write(ident, nil)
+			}
+		}
+	}
+}
+
+func (self *Checker) VisitDeclStmt(node *ast.DeclStmt) {
+	self.debug(node)
+
+	self.exprs(node.Values)
+	lhs := make([]ast.Expr, len(node.Names))
+	for i, name := range node.Names {
+		lhs[i] = name
+	}
+	self.assign(lhs, node.Values)
+}
+
+func (self *Checker) VisitDeferStmt(node *ast.DeferStmt) {
+	self.debug(node)
+
+	node.Call.Accept(self)
+}
+
+func (self *Checker) VisitGoStmt(node *ast.GoStmt) {
+	self.debug(node)
+
+	node.Call.Accept(self)
+}
+
+func (self *Checker) VisitReturnStmt(node *ast.ReturnStmt) {
+	self.debug(node)
+
+	self.exprs(node.Results)
+}
+
+func (self *Checker) VisitBranchStmt(node *ast.BranchStmt) {
+	self.debug(node)
+
+	if self.loops == 0 {
+		self.report(node.TokPos, Error, "branch", "%s is not in a loop", token.Tokens[node.Tok])
+	}
+}
+
+func (self *Checker) VisitBlockStmt(node *ast.BlockStmt) {
+	self.debug(node)
+
+	self.stmts(node.List)
+}
+
+func (self *Checker) VisitIfStmt(node *ast.IfStmt) {
+	self.debug(node)
+
+	node.Cond.Accept(self)
+	node.Body.Accept(self)
+	if node.Else != nil {
+		node.Else.Accept(self)
+	}
+}
+
+func (self *Checker) VisitCaseClause(node *ast.CaseClause) {
+	self.debug(node)
+
+	self.exprs(node.List)
+	self.stmts(node.Body)
+}
+
+func (self *Checker) VisitSwitchStmt(node *ast.SwitchStmt) {
+	self.debug(node)
+
+	node.Init.Accept(self)
+	node.Body.Accept(self)
+}
+
+func (self *Checker) VisitSelectStmt(node *ast.SelectStmt) {
+	self.debug(node)
+
+	node.Body.Accept(self)
+}
+
+func (self *Checker) VisitForStmt(node *ast.ForStmt) {
+	self.debug(node)
+
+	if node.Init != nil {
+		node.Init.Accept(self)
+	}
+	node.Cond.Accept(self)
+	self.loops++
+	node.Body.Accept(self)
+	self.loops--
+	if node.Post != nil {
+		node.Post.Accept(self)
+	}
+}
+
+func (self *Checker) VisitRangeStmt(node *ast.RangeStmt) {
+	self.debug(node)
+
+	node.X.Accept(self)
+	for _, kv := range node.KeyValue {
+		self.writeTarget(kv, nil)
+	}
+	self.loops++
+	node.Body.Accept(self)
+	self.loops--
+}
+
+func (self *Checker) VisitTryStmt(node *ast.TryStmt) {
+	self.debug(node)
+
+	node.Body.Accept(self)
+	if node.Handler != nil {
+		if node.Err != nil {
+			self.write(node.Err, nil)
+		}
+		node.Handler.Accept(self)
+	}
+	if node.Finally != nil {
+		node.Finally.Accept(self)
+	}
+}
@@ -0,0 +1,525 @@
+package compile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// A .dc file caches the compiled form of a script:
+//
+//	magic    "DBC\x00"
+//	version  uvarint
+//	hash     sha256 of the source
+//	file     size and line offsets of the source
+//	main     the proto tree
+//	crc      crc32 of all the above, little endian
+//
+// A proto is its name, parameter count, locals, upvals, constants,
+// names, code, positions and nested protos. Counts and indexes are
+// uvarints, positions are file offsets plus one so that 0 is
+// token.NoPos.
+
+// Version is the version of the .dc format. Bump it whenever the
+// format or the meaning of the instructions changes.
+const Version = 10
+
+var magic = []byte("DBC\x00")
+
+var (
+	ErrCacheStale   = errors.New("bytecode cache is out of date")
+	ErrCacheVersion = errors.New("bytecode cache has another version")
+	ErrCacheCorrupt = errors.New("bytecode cache is corrupt")
+)
+
+// constant tags
+const (
+	tagInt byte = iota + 1
+	tagFloat
+	tagString
+	tagComplex
+	tagRune
+	tagBigInt
+)
+
+// CachePath is where the cache of a script is kept: foo.d caches to
+// foo.dc.
+func CachePath(filename string) string {
+	return strings.TrimSuffix(filename, ".d") + ".dc"
+}
+
+// WriteCache writes proto, compiled from the script filename with
+// source src, to its cache. The file is written aside and renamed,
+// so a reader never sees it half written.
+func WriteCache(fset *token.FileSet, filename string, proto *Proto, src []byte) error {
+	data, err := EncodeCache(fset, proto, src)
+	if err != nil {
+		return err
+	}
+	path := CachePath(filename)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadCache returns the cached proto of the script filename if it
+// was compiled from src by this version, and adds filename to fset.
+func ReadCache(fset *token.FileSet, filename string, src []byte) (*Proto, error) {
+	data, err := ioutil.ReadFile(CachePath(filename))
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCache(data, fset, filename, src)
+}
+
+/// encoding
+
+type encoder struct {
+	buf  bytes.Buffer
+	file *token.File
+}
+
+func (self *encoder) uint(n int) {
+	var b [binary.MaxVarintLen64]byte
+	self.buf.Write(b[:binary.PutUvarint(b[:], uint64(n))])
+}
+
+func (self *encoder) int(n int) {
+	var b [binary.MaxVarintLen64]byte
+	self.buf.Write(b[:binary.PutVarint(b[:], int64(n))])
+}
+
+func (self *encoder) float(f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	self.buf.Write(b[:])
+}
+
+func (self *encoder) bool(b bool) {
+	if b {
+		self.buf.WriteByte(1)
+	} else {
+		self.buf.WriteByte(0)
+	}
+}
+
+func (self *encoder) string(s string) {
+	self.uint(len(s))
+	self.buf.WriteString(s)
+}
+
+func (self *encoder) pos(pos token.Pos) {
+	if !pos.IsValid() {
+		self.uint(0)
+		return
+	}
+	self.uint(self.file.Offset(pos) + 1)
+}
+
+// EncodeCache encodes proto, compiled from src, in the .dc format.
+func EncodeCache(fset *token.FileSet, proto *Proto, src []byte) ([]byte, error) {
+	file := protoFile(fset, proto)
+	if file == nil {
+		return nil, errors.New("bytecode cache: no source file")
+	}
+
+	e := &encoder{file: file}
+	hash := sha256.Sum256(src)
+	e.buf.Write(magic)
+	e.uint(Version)
+	e.buf.Write(hash[:])
+
+	e.uint(file.Size())
+	lines := file.Lines()
+	e.uint(len(lines))
+	for i, offset := range lines {
+		if i > 0 {
+			offset -= lines[i-1]
+		}
+		e.uint(offset)
+	}
+
+	e.proto(proto)
+
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(e.buf.Bytes()))
+	e.buf.Write(crc[:])
+	return e.buf.Bytes(), nil
+}
+
+// protoFile finds the file the code of proto comes from.
+func protoFile(fset *token.FileSet, proto *Proto) *token.File {
+	for _, pos := range proto.Pos {
+		if f := fset.File(pos); f != nil {
+			return f
+		}
+	}
+	for _, p := range proto.Protos {
+		if f := protoFile(fset, p); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (self *encoder) proto(proto *Proto) {
+	self.string(proto.Name)
+	self.uint(proto.NumParams)
+
+	self.uint(len(proto.Locals))
+	for i, name := range proto.Locals {
+		self.string(name)
+		self.bool(proto.Captured[i])
+	}
+
+	self.uint(len(proto.Upvals))
+	for _, up := range proto.Upvals {
+		self.string(up.Name)
+		self.bool(up.Local)
+		self.uint(up.Index)
+	}
+
+	self.uint(len(proto.Consts))
+	for _, obj := range proto.Consts {
+		switch v := obj.(type) {
+		case *rt.IntegerObject:
+			self.buf.WriteByte(tagInt)
+			self.int(v.Val)
+		case *rt.FloatObject:
+			self.buf.WriteByte(tagFloat)
+			self.float(v.Val)
+		case *rt.ComplexObject:
+			self.buf.WriteByte(tagComplex)
+			self.float(real(v.Val))
+			self.float(imag(v.Val))
+		case *rt.StringObject:
+			self.buf.WriteByte(tagString)
+			self.string(v.Val)
+		case *rt.RuneObject:
+			self.buf.WriteByte(tagRune)
+			self.int(int(v.Val))
+		case *rt.BigIntObject:
+			self.buf.WriteByte(tagBigInt)
+			self.string(v.Val.String())
+		default:
+			panic("bytecode cache: unexpected constant " + obj.Name())
+		}
+	}
+
+	self.uint(len(proto.Names))
+	for _, name := range proto.Names {
+		self.string(name)
+	}
+
+	self.uint(len(proto.Code))
+	for i, in := range proto.Code {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(in))
+		self.buf.Write(b[:])
+		self.pos(proto.Pos[i])
+	}
+
+	self.uint(len(proto.Protos))
+	for _, p := range proto.Protos {
+		self.proto(p)
+	}
+}
+
+/// decoding
+
+// decoder reads a .dc file. Malformed input panics with
+// ErrCacheCorrupt, which DecodeCache turns into its error.
+type decoder struct {
+	data []byte
+	size int // size of the source file
+}
+
+func (self *decoder) fail() {
+	panic(ErrCacheCorrupt)
+}
+
+func (self *decoder) bytes(n int) []byte {
+	if n > len(self.data) {
+		self.fail()
+	}
+	b := self.data[:n]
+	self.data = self.data[n:]
+	return b
+}
+
+func (self *decoder) byte() byte {
+	return self.bytes(1)[0]
+}
+
+func (self *decoder) uint() int {
+	n, k := binary.Uvarint(self.data)
+	if k <= 0 || n > math.MaxInt32 {
+		self.fail()
+	}
+	self.data = self.data[k:]
+	return int(n)
+}
+
+func (self *decoder) int() int {
+	n, k := binary.Varint(self.data)
+	if k <= 0 || int64(int(n)) != n {
+		self.fail()
+	}
+	self.data = self.data[k:]
+	return int(n)
+}
+
+func (self *decoder) float() float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(self.bytes(8)))
+}
+
+// count reads the length of a list whose items take at least one
+// byte each, so that a corrupt count cannot allocate much.
+func (self *decoder) count() int {
+	n := self.uint()
+	if n > len(self.data) {
+		self.fail()
+	}
+	return n
+}
+
+func (self *decoder) bool() bool {
+	switch self.byte() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	self.fail()
+	return false
+}
+
+func (self *decoder) string() string {
+	return string(self.bytes(self.uint()))
+}
+
+func (self *decoder) pos() token.Pos {
+	offset := self.uint()
+	if offset > self.size+1 {
+		self.fail()
+	}
+	return token.Pos(offset)
+}
+
+// DecodeCache decodes a .dc file made from src by this version and
+// adds the source file to fset as filename.
+func DecodeCache(data []byte, fset *token.FileSet, filename string, src []byte) (proto *Proto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != ErrCacheCorrupt {
+				panic(r)
+			}
+			proto, err = nil, ErrCacheCorrupt
+		}
+	}()
+
+	d := &decoder{data: data}
+	if !bytes.Equal(d.bytes(len(magic)), magic) {
+		return nil, ErrCacheCorrupt
+	}
+	if d.uint() != Version {
+		return nil, ErrCacheVersion
+	}
+	if len(d.data) < 4 {
+		return nil, ErrCacheCorrupt
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, ErrCacheCorrupt
+	}
+	d.data = d.data[:len(d.data)-4]
+
+	hash := sha256.Sum256(src)
+	if !bytes.Equal(d.bytes(len(hash)), hash[:]) {
+		return nil, ErrCacheStale
+	}
+
+	d.size = d.uint()
+	if d.size != len(src) {
+		d.fail()
+	}
+	lines := make([]int, d.count())
+	for i := range lines {
+		lines[i] = d.uint()
+		if i > 0 {
+			lines[i] += lines[i-1]
+			if lines[i] <= lines[i-1] || lines[i] >= d.size {
+				d.fail()
+			}
+		}
+	}
+	if len(lines) == 0 || lines[0] != 0 {
+		d.fail()
+	}
+
+	proto = d.proto()
+	if len(d.data) != 0 || len(proto.Upvals) != 0 {
+		d.fail()
+	}
+	verify(proto, nil)
+
+	file := fset.AddFile(filename, d.size)
+	file.SetLines(lines)
+	rebase(proto, file)
+	return proto, nil
+}
+
+func (self *decoder) proto() *Proto {
+	proto := &Proto{Name: self.string(), NumParams: self.uint()}
+
+	n := self.count()
+	proto.Locals = make([]string, n)
+	proto.Captured = make([]bool, n)
+	for i := 0; i < n; i++ {
+		proto.Locals[i] = self.string()
+		proto.Captured[i] = self.bool()
+	}
+
+	proto.Upvals = make([]Upval, self.count())
+	for i := range proto.Upvals {
+		proto.Upvals[i] = Upval{self.string(), self.bool(), self.uint()}
+	}
+
+	proto.Consts = make([]rt.Object, self.count())
+	for i := range proto.Consts {
+		switch self.byte() {
+		case tagInt:
+			proto.Consts[i] = rt.NewIntegerObject(self.int())
+		case tagFloat:
+			proto.Consts[i] = rt.NewFloatObject(self.float())
+		case tagComplex:
+			re := self.float()
+			proto.Consts[i] = rt.NewComplexObject(complex(re, self.float()))
+		case tagString:
+			proto.Consts[i] = rt.NewStringObject(self.string())
+		case tagRune:
+			proto.Consts[i] = rt.NewRuneObject(rune(self.int()))
+		case tagBigInt:
+			val, ok := new(big.Int).SetString(self.string(), 10)
+			if !ok {
+				self.fail()
+			}
+			proto.Consts[i] = rt.NewBigIntObject(val)
+		default:
+			self.fail()
+		}
+	}
+
+	proto.Names = make([]string, self.count())
+	for i := range proto.Names {
+		proto.Names[i] = self.string()
+	}
+
+	n = self.count()
+	proto.Code = make([]Instr, n)
+	proto.Pos = make([]token.Pos, n)
+	for i := 0; i < n; i++ {
+		proto.Code[i] = Instr(binary.LittleEndian.Uint32(self.bytes(4)))
+		proto.Pos[i] = self.pos()
+	}
+
+	proto.Protos = make([]*Proto, self.count())
+	for i := range proto.Protos {
+		proto.Protos[i] = self.proto()
+	}
+	return proto
+}
+
+// verify checks that the operands of the code of proto are in range,
+// so that a corrupt cache cannot make the vm index out of its tables.
+func verify(proto, outer *Proto) {
+	fail := func() { panic(ErrCacheCorrupt) }
+
+	if proto.NumParams > len(proto.Locals) {
+		fail()
+	}
+	for _, up := range proto.Upvals {
+		if outer == nil ||
+			up.Local && (up.Index >= len(outer.Locals) || !outer.Captured[up.Index]) ||
+			!up.Local && up.Index >= len(outer.Upvals) {
+			fail()
+		}
+	}
+
+	n := len(proto.Code)
+	if n == 0 {
+		fail()
+	}
+	switch proto.Code[n-1].Op() {
+	case RETURN, RETURN_RESULTS, RETURN_SAVED:
+	default:
+		fail()
+	}
+
+	for _, in := range proto.Code {
+		arg := in.Arg()
+		var limit int
+		switch op := in.Op(); op {
+		case LOAD_CONST:
+			limit = len(proto.Consts)
+		case LOAD_LOCAL, STORE_LOCAL, ITER, FOR_ITER:
+			limit = len(proto.Locals)
+		case LOAD_CELL, STORE_CELL, FRESH_CELL:
+			if arg >= len(proto.Locals) || !proto.Captured[arg] {
+				fail()
+			}
+			continue
+		case LOAD_UPVAL, STORE_UPVAL:
+			limit = len(proto.Upvals)
+		case LOAD_GLOBAL, STORE_GLOBAL, GET_PROP, SET_PROP:
+			limit = len(proto.Names)
+		case UNARY, BINARY, INPLACE:
+			limit = len(token.Tokens)
+		case CLOSURE:
+			limit = len(proto.Protos)
+		case JUMP, JUMP_IF_FALSE, TRY:
+			limit = n
+		default:
+			if int(op) >= len(opNames) {
+				fail()
+			}
+			continue
+		}
+		if arg >= limit {
+			fail()
+		}
+	}
+
+	for _, p := range proto.Protos {
+		verify(p, proto)
+	}
+}
+
+// rebase turns the offsets of a decoded proto into positions of
+// file.
+func rebase(proto *Proto, file *token.File) {
+	for i, offset := range proto.Pos {
+		if offset != token.NoPos {
+			proto.Pos[i] = file.Pos(int(offset) - 1)
+		}
+	}
+	for _, p := range proto.Protos {
+		rebase(p, file)
+	}
+}
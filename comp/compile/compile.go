@@ -0,0 +1,804 @@
+package compile
+
+import (
+	"fmt"
+
+	"github.com/jxwr/doubi/ast"
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// Compiler lowers statements to a Proto. The statements must have
+// been resolved by comp.Attr, which decides where every variable
+// lives; the compiler only adds temporaries.
+type Compiler struct {
+	Fset *token.FileSet
+
+	fs *funcState
+}
+
+// funcState is the function being compiled.
+type funcState struct {
+	outer *funcState
+	proto *Proto
+
+	consts map[string]int
+	names  map[string]int
+	free   []int // temporaries to reuse
+
+	loops   []*loop
+	trys    []*ast.BlockStmt // finally blocks of the enclosing trys, or nil
+	returns []int            // top level returns, see returnStmt
+}
+
+// loop collects the jumps of break and continue statements.
+type loop struct {
+	breaks    []int
+	continues []int
+	trys      int // trys enclosing the loop
+}
+
+func NewCompiler(fset *token.FileSet) *Compiler {
+	return &Compiler{fset, nil}
+}
+
+// Compile compiles a script resolved by comp.Attr.Script.
+func (self *Compiler) Compile(script *ast.FuncDeclExpr) (proto *Proto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			self.fs = nil
+			err = e
+		}
+	}()
+
+	self.open(&Proto{
+		Name:     "main",
+		Locals:   append([]string{}, script.Locals...),
+		Captured: append([]bool{}, script.Captured...),
+	})
+	var end token.Pos
+	for _, stmt := range script.Body.List {
+		self.stmt(stmt)
+		for _, pc := range self.fs.returns {
+			self.patch(pc)
+		}
+		self.fs.returns = nil
+		end = stmt.End()
+	}
+	self.emit(RETURN, 0, end)
+	return self.close(), nil
+}
+
+func (self *Compiler) error(pos token.Pos, format string, args ...interface{}) {
+	panic(&Error{self.Fset.Position(pos), fmt.Sprintf(format, args...)})
+}
+
+/// functions
+
+func (self *Compiler) open(proto *Proto) {
+	self.fs = &funcState{
+		outer:  self.fs,
+		proto:  proto,
+		consts: map[string]int{},
+		names:  map[string]int{},
+	}
+}
+
+// close finishes the current function. Accesses to locals that
+// closures captured go through their cells.
+func (self *Compiler) close() *Proto {
+	proto := self.fs.proto
+	for i, in := range proto.Code {
+		switch in.Op() {
+		case LOAD_LOCAL:
+			if proto.Captured[in.Arg()] {
+				proto.Code[i] = MakeInstr(LOAD_CELL, in.Arg())
+			}
+		case STORE_LOCAL:
+			if proto.Captured[in.Arg()] {
+				proto.Code[i] = MakeInstr(STORE_CELL, in.Arg())
+			}
+		}
+	}
+	self.fs = self.fs.outer
+	return proto
+}
+
+func (self *Compiler) isMain() bool {
+	return self.fs.outer == nil
+}
+
+func (self *Compiler) function(name string, node *ast.FuncDeclExpr) int {
+	seen := map[string]bool{}
+	for _, arg := range node.Args {
+		if seen[arg.Name] {
+			self.error(arg.NamePos, "duplicate argument %s", arg.Name)
+		}
+		seen[arg.Name] = true
+	}
+
+	proto := &Proto{Name: name, NumParams: len(node.Args)}
+	proto.Locals = append([]string{}, node.Locals...)
+	proto.Captured = append([]bool{}, node.Captured...)
+	for _, up := range node.Upvals {
+		proto.Upvals = append(proto.Upvals, Upval{up.Name, up.Ref.Depth == 0, up.Ref.Slot})
+	}
+	self.open(proto)
+
+	// a body falling off its end returns nil
+	for _, stmt := range node.Body.List {
+		self.stmt(stmt)
+	}
+	self.emit(RETURN, 0, node.Body.Rbrack)
+
+	self.close()
+	self.fs.proto.Protos = append(self.fs.proto.Protos, proto)
+	return len(self.fs.proto.Protos) - 1
+}
+
+func isFuncDecl(expr ast.Expr) bool {
+	decl, ok := expr.(*ast.FuncDeclExpr)
+	return ok && decl.Name != nil
+}
+
+// funcDecl compiles func name() {}, which binds name in the current
+// function, or as a global at the top level.
+func (self *Compiler) funcDecl(node *ast.FuncDeclExpr) {
+	idx := self.function(node.Name.Name, node)
+	self.emit(CLOSURE, idx, node.Func)
+	self.store(node.Name)
+}
+
+/// variables
+
+func (self *Compiler) temp() int {
+	if n := len(self.fs.free); n > 0 {
+		slot := self.fs.free[n-1]
+		self.fs.free = self.fs.free[:n-1]
+		return slot
+	}
+	proto := self.fs.proto
+	proto.Locals = append(proto.Locals, "")
+	proto.Captured = append(proto.Captured, false)
+	return len(proto.Locals) - 1
+}
+
+func (self *Compiler) release(slot int) {
+	self.fs.free = append(self.fs.free, slot)
+}
+
+func (self *Compiler) load(node *ast.Ident) {
+	switch node.Name {
+	case "true":
+		self.emit(LOAD_TRUE, 0, node.NamePos)
+		return
+	case "false":
+		self.emit(LOAD_FALSE, 0, node.NamePos)
+		return
+	case "nil":
+		self.emit(LOAD_NIL, 0, node.NamePos)
+		return
+	}
+
+	switch ref := node.Ref; {
+	case ref == nil:
+		self.emit(LOAD_GLOBAL, self.name(node.Name), node.NamePos)
+	case ref.Depth == 0:
+		self.emit(LOAD_LOCAL, ref.Slot, node.NamePos)
+	default:
+		self.emit(LOAD_UPVAL, ref.Slot, node.NamePos)
+	}
+}
+
+// store pops the top of the stack into a variable.
+func (self *Compiler) store(node *ast.Ident) {
+	if node.Name == "_" {
+		self.emit(POP, 1, node.NamePos)
+		return
+	}
+
+	switch ref := node.Ref; {
+	case ref == nil:
+		self.emit(STORE_GLOBAL, self.name(node.Name), node.NamePos)
+	case ref.Depth == 0:
+		self.emit(STORE_LOCAL, ref.Slot, node.NamePos)
+	default:
+		self.emit(STORE_UPVAL, ref.Slot, node.NamePos)
+	}
+}
+
+/// tables
+
+func (self *Compiler) name(name string) int {
+	if idx, ok := self.fs.names[name]; ok {
+		return idx
+	}
+	proto := self.fs.proto
+	proto.Names = append(proto.Names, name)
+	self.fs.names[name] = len(proto.Names) - 1
+	return len(proto.Names) - 1
+}
+
+func (self *Compiler) constant(key string, obj rt.Object) int {
+	if idx, ok := self.fs.consts[key]; ok {
+		return idx
+	}
+	proto := self.fs.proto
+	proto.Consts = append(proto.Consts, obj)
+	self.fs.consts[key] = len(proto.Consts) - 1
+	return len(proto.Consts) - 1
+}
+
+/// code
+
+func (self *Compiler) emit(op Opcode, arg int, pos token.Pos) int {
+	if arg < 0 || arg > MaxArg {
+		self.error(pos, "too many operands for %s", op)
+	}
+	proto := self.fs.proto
+	proto.Code = append(proto.Code, MakeInstr(op, arg))
+	proto.Pos = append(proto.Pos, pos)
+	return len(proto.Code) - 1
+}
+
+func (self *Compiler) emitAB(op Opcode, a, b int, pos token.Pos) int {
+	if a > MaxArgB || b > MaxArgB {
+		self.error(pos, "too many operands for %s", op)
+	}
+	return self.emit(op, a|b<<12, pos)
+}
+
+func (self *Compiler) here() int {
+	return len(self.fs.proto.Code)
+}
+
+// patch points the jump at pc to the next instruction.
+func (self *Compiler) patch(pc int) {
+	code := self.fs.proto.Code
+	code[pc] = MakeInstr(code[pc].Op(), self.here())
+}
+
+/// exprs
+
+// expr compiles an expression that leaves one value on the stack.
+func (self *Compiler) expr(expr ast.Expr) {
+	switch node := expr.(type) {
+	case *ast.BadExpr:
+		self.error(node.From, "bad expression")
+	case *ast.Ident:
+		self.load(node)
+	case *ast.BasicLit:
+		self.basicLit(node)
+	case *ast.ParenExpr:
+		self.expr(node.X)
+	case *ast.SelectorExpr:
+		self.expr(node.X)
+		self.emit(GET_PROP, self.name(node.Sel.Name), node.Sel.NamePos)
+	case *ast.IndexExpr:
+		self.expr(node.X)
+		self.expr(node.Index)
+		self.emit(GET_INDEX, 0, node.Lbrack)
+	case *ast.SliceExpr:
+		self.expr(node.X)
+		flags := 0
+		if node.Low != nil {
+			self.expr(node.Low)
+			flags |= 1
+		}
+		if node.High != nil {
+			self.expr(node.High)
+			flags |= 2
+		}
+		self.emit(SLICE, flags, node.Lbrack)
+	case *ast.CallExpr:
+		self.call(node, 1)
+	case *ast.UnaryExpr:
+		self.expr(node.X)
+		self.emit(UNARY, int(node.Op), node.OpPos)
+	case *ast.BinaryExpr:
+		self.expr(node.X)
+		self.expr(node.Y)
+		self.emit(BINARY, int(node.Op), node.OpPos)
+	case *ast.ArrayExpr:
+		for _, elem := range node.Elems {
+			self.expr(elem)
+		}
+		self.emit(ARRAY, len(node.Elems), node.Lbrack)
+	case *ast.SetExpr:
+		for _, elem := range node.Elems {
+			self.expr(elem)
+		}
+		self.emit(SET, len(node.Elems), node.Hash)
+	case *ast.DictExpr:
+		for _, field := range node.Fields {
+			self.expr(field.Name)
+			self.expr(field.Value)
+		}
+		self.emit(DICT, len(node.Fields), node.Hash)
+	case *ast.FuncDeclExpr:
+		if node.Name != nil {
+			self.funcDecl(node)
+			self.load(node.Name)
+		} else {
+			idx := self.function("#<closure>", node)
+			self.emit(CLOSURE, idx, node.Func)
+		}
+	default:
+		self.error(expr.Pos(), "unexpected expression")
+	}
+}
+
+func (self *Compiler) basicLit(node *ast.BasicLit) {
+	obj, err := rt.ParseLit(node.Kind, node.Value)
+	if err != nil {
+		self.error(node.ValuePos, "%v", err)
+	}
+	key := token.Tokens[node.Kind] + ":" + node.Value
+	self.emit(LOAD_CONST, self.constant(key, obj), node.ValuePos)
+}
+
+// call compiles a call giving want results, or all of them and
+// their count when want is Multi.
+func (self *Compiler) call(node *ast.CallExpr, want int) {
+	self.expr(node.Fun)
+	n := self.values(node.Args)
+	self.emitAB(CALL, n, want, node.Lparen)
+}
+
+// values compiles exprs to one value each and returns their count.
+// A single call spreads all of its results and gives Multi.
+func (self *Compiler) values(exprs []ast.Expr) int {
+	if len(exprs) == 1 {
+		if call, ok := exprs[0].(*ast.CallExpr); ok {
+			self.call(call, Multi)
+			return Multi
+		}
+	}
+
+	for _, expr := range exprs {
+		self.expr(expr)
+	}
+	return len(exprs)
+}
+
+/// stmts
+
+func (self *Compiler) block(node *ast.BlockStmt) {
+	for _, stmt := range node.List {
+		self.stmt(stmt)
+	}
+}
+
+func (self *Compiler) stmt(stmt ast.Stmt) {
+	switch node := stmt.(type) {
+	case *ast.BadStmt:
+		self.error(node.From, "bad statement")
+	case *ast.ExprStmt:
+		if call, ok := node.X.(*ast.CallExpr); ok {
+			self.call(call, Multi)
+			self.emit(POP_RESULTS, 0, call.Lparen)
+		} else if isFuncDecl(node.X) {
+			self.funcDecl(node.X.(*ast.FuncDeclExpr))
+		} else {
+			self.expr(node.X)
+			self.emit(POP, 1, node.X.Pos())
+		}
+	case *ast.SendStmt, *ast.SelectStmt:
+		// not implemented, as in comp.Eval
+	case *ast.IncDecStmt:
+		if node.Tok == token.INC {
+			self.update(node.X, INC, 0, node.TokPos)
+		} else {
+			self.update(node.X, DEC, 0, node.TokPos)
+		}
+	case *ast.AssignStmt:
+		self.assign(node)
+	case *ast.DeclStmt:
+		self.declStmt(node)
+	case *ast.DeferStmt:
+		self.expr(node.Call.Fun)
+		n := self.values(node.Call.Args)
+		self.emit(DEFER, n, node.Call.Lparen)
+	case *ast.GoStmt:
+		// the vm is single threaded: the call runs to completion
+		self.call(node.Call, Multi)
+		self.emit(POP_RESULTS, 0, node.Call.Lparen)
+	case *ast.ReturnStmt:
+		self.returnStmt(node)
+	case *ast.BranchStmt:
+		self.branch(node)
+	case *ast.BlockStmt:
+		self.block(node)
+	case *ast.IfStmt:
+		self.ifStmt(node)
+	case *ast.SwitchStmt:
+		self.switchStmt(node)
+	case *ast.ForStmt:
+		self.forStmt(node)
+	case *ast.RangeStmt:
+		self.rangeStmt(node)
+	case *ast.TryStmt:
+		self.tryStmt(node)
+	default:
+		self.error(stmt.Pos(), "unexpected statement")
+	}
+}
+
+func (self *Compiler) assign(node *ast.AssignStmt) {
+	n := self.values(node.Rhs)
+	if n == Multi {
+		n = len(node.Lhs)
+		self.emit(UNPACK, n, node.TokPos)
+	} else if n != len(node.Lhs) {
+		// UNPACK raises the mismatch when the statement runs
+		self.emit(RESULTS, n, node.TokPos)
+		self.emit(UNPACK, len(node.Lhs), node.TokPos)
+		n = len(node.Lhs)
+	}
+
+	if n == 1 {
+		self.assignTo(node.Lhs[0], node)
+		return
+	}
+
+	// all values are evaluated before any is assigned: a, b = b, a
+	temps := make([]int, n)
+	for i := n - 1; i >= 0; i-- {
+		temps[i] = self.temp()
+		self.emit(STORE_LOCAL, temps[i], node.TokPos)
+	}
+	for i, lhs := range node.Lhs {
+		self.emit(LOAD_LOCAL, temps[i], node.TokPos)
+		self.assignTo(lhs, node)
+		self.release(temps[i])
+	}
+}
+
+// assignTo pops the value on the stack into lhs.
+func (self *Compiler) assignTo(lhs ast.Expr, node *ast.AssignStmt) {
+	if node.Tok == token.ASSIGN || node.Tok == token.DEFINE {
+		switch v := lhs.(type) {
+		case *ast.Ident:
+			if node.Tok == token.DEFINE {
+				self.fresh(v)
+			}
+			self.store(v)
+		case *ast.IndexExpr:
+			self.expr(v.X)
+			self.expr(v.Index)
+			self.emit(SET_INDEX, 0, v.Lbrack)
+		case *ast.SelectorExpr:
+			self.expr(v.X)
+			self.emit(SET_PROP, self.name(v.Sel.Name), v.Sel.NamePos)
+		default:
+			self.error(lhs.Pos(), "cannot assign to expression")
+		}
+		return
+	}
+
+	self.update(lhs, INPLACE, int(node.Tok), node.TokPos)
+}
+
+// update turns the value of lhs into its new value with op, INPLACE
+// with the value on the stack, INC or DEC, and stores it back. The
+// parts of lhs are evaluated once.
+func (self *Compiler) update(lhs ast.Expr, op Opcode, arg int, pos token.Pos) {
+	switch v := lhs.(type) {
+	case *ast.Ident:
+		self.load(v)
+		self.emit(op, arg, pos)
+		self.store(v)
+	case *ast.IndexExpr:
+		// a[b] += c
+		x, i := self.temp(), self.temp()
+		self.expr(v.X)
+		self.emit(STORE_LOCAL, x, v.Lbrack)
+		self.expr(v.Index)
+		self.emit(STORE_LOCAL, i, v.Lbrack)
+		self.emit(LOAD_LOCAL, x, v.Lbrack)
+		self.emit(LOAD_LOCAL, i, v.Lbrack)
+		self.emit(GET_INDEX, 0, v.Lbrack)
+		self.emit(op, arg, pos)
+		self.emit(LOAD_LOCAL, x, v.Lbrack)
+		self.emit(LOAD_LOCAL, i, v.Lbrack)
+		self.emit(SET_INDEX, 0, v.Lbrack)
+		self.release(i)
+		self.release(x)
+	case *ast.SelectorExpr:
+		x := self.temp()
+		self.expr(v.X)
+		self.emit(STORE_LOCAL, x, v.Sel.NamePos)
+		self.emit(LOAD_LOCAL, x, v.Sel.NamePos)
+		self.emit(GET_PROP, self.name(v.Sel.Name), v.Sel.NamePos)
+		self.emit(op, arg, pos)
+		self.emit(LOAD_LOCAL, x, v.Sel.NamePos)
+		self.emit(SET_PROP, self.name(v.Sel.Name), v.Sel.NamePos)
+		self.release(x)
+	default:
+		self.error(lhs.Pos(), "cannot assign to expression")
+	}
+}
+
+// declStmt compiles var and const, which assign like :=.
+func (self *Compiler) declStmt(node *ast.DeclStmt) {
+	if len(node.Values) > 0 {
+		lhs := make([]ast.Expr, len(node.Names))
+		for i, name := range node.Names {
+			lhs[i] = name
+		}
+		self.assign(&ast.AssignStmt{lhs, node.TokPos, token.DEFINE, node.Values})
+		return
+	}
+	for _, name := range node.Names {
+		if name.Name == "_" {
+			continue
+		}
+		self.emit(LOAD_NIL, 0, name.NamePos)
+		self.fresh(name)
+		self.store(name)
+	}
+}
+
+func (self *Compiler) returnStmt(node *ast.ReturnStmt) {
+	n := self.values(node.Results)
+	if self.isMain() {
+		// at the top level return leaves the current statement, as
+		// in comp.Eval, and the script goes on
+		if n == Multi {
+			self.emit(POP_RESULTS, 0, node.Return)
+		} else {
+			self.emit(POP, n, node.Return)
+		}
+		self.unwind(0, node.Return)
+		self.fs.returns = append(self.fs.returns, self.emit(JUMP, 0, node.Return))
+		return
+	}
+
+	if len(self.fs.trys) == 0 {
+		if n == Multi {
+			self.emit(RETURN_RESULTS, 0, node.Return)
+		} else {
+			self.emit(RETURN, n, node.Return)
+		}
+		return
+	}
+
+	// the finally blocks run before the function returns
+	self.emit(SAVE_RESULTS, n, node.Return)
+	self.unwind(0, node.Return)
+	self.emit(RETURN_SAVED, 0, node.Return)
+}
+
+// unwind leaves the trys entered after the first depth ones,
+// running their finally blocks.
+func (self *Compiler) unwind(depth int, pos token.Pos) {
+	trys := self.fs.trys
+	for i := len(trys) - 1; i >= depth; i-- {
+		self.emit(END_TRY, 0, pos)
+		if trys[i] != nil {
+			self.fs.trys = trys[:i]
+			self.block(trys[i])
+		}
+	}
+	self.fs.trys = trys
+}
+
+func (self *Compiler) branch(node *ast.BranchStmt) {
+	loops := self.fs.loops
+	if len(loops) == 0 {
+		self.error(node.TokPos, "%s is not in a loop", token.Tokens[node.Tok])
+	}
+	l := loops[len(loops)-1]
+
+	self.unwind(l.trys, node.TokPos)
+	pc := self.emit(JUMP, 0, node.TokPos)
+	switch node.Tok {
+	case token.BREAK:
+		l.breaks = append(l.breaks, pc)
+	case token.CONTINUE:
+		l.continues = append(l.continues, pc)
+	default:
+		self.error(node.TokPos, "%s is not supported", token.Tokens[node.Tok])
+	}
+}
+
+func (self *Compiler) ifStmt(node *ast.IfStmt) {
+	self.expr(node.Cond)
+	jf := self.emit(JUMP_IF_FALSE, 0, node.Cond.Pos())
+	self.block(node.Body)
+	if node.Else != nil {
+		j := self.emit(JUMP, 0, node.If)
+		self.patch(jf)
+		self.stmt(node.Else)
+		self.patch(j)
+	} else {
+		self.patch(jf)
+	}
+}
+
+// switchStmt compiles the cases in order. A literal case matches a
+// tag equal to it, any other case is a condition, and all of the
+// expressions of a case must hold.
+func (self *Compiler) switchStmt(node *ast.SwitchStmt) {
+	tag, ok := node.Init.(*ast.ExprStmt)
+	if !ok {
+		self.error(node.Init.Pos(), "switch expects an expression")
+	}
+	self.expr(tag.X)
+	slot := self.temp()
+	self.emit(STORE_LOCAL, slot, node.Switch)
+
+	ends := []int{}
+	for _, stmt := range node.Body.List {
+		clause := stmt.(*ast.CaseClause)
+		nexts := []int{}
+		for _, e := range clause.List {
+			if _, ok := e.(*ast.BasicLit); ok {
+				self.emit(LOAD_LOCAL, slot, e.Pos())
+				self.expr(e)
+				self.emit(BINARY, int(token.EQL), e.Pos())
+			} else {
+				self.expr(e)
+			}
+			nexts = append(nexts, self.emit(JUMP_IF_FALSE, 0, e.Pos()))
+		}
+		for _, s := range clause.Body {
+			self.stmt(s)
+		}
+		ends = append(ends, self.emit(JUMP, 0, clause.Case))
+		for _, pc := range nexts {
+			self.patch(pc)
+		}
+	}
+	for _, pc := range ends {
+		self.patch(pc)
+	}
+	self.release(slot)
+}
+
+func (self *Compiler) openLoop() *loop {
+	l := &loop{trys: len(self.fs.trys)}
+	self.fs.loops = append(self.fs.loops, l)
+	return l
+}
+
+// closeLoop points the breaks of l to the next instruction and its
+// continues to cont.
+func (self *Compiler) closeLoop(l *loop, cont int) {
+	code := self.fs.proto.Code
+	for _, pc := range l.breaks {
+		self.patch(pc)
+	}
+	for _, pc := range l.continues {
+		code[pc] = MakeInstr(JUMP, cont)
+	}
+	self.fs.loops = self.fs.loops[:len(self.fs.loops)-1]
+}
+
+func (self *Compiler) forStmt(node *ast.ForStmt) {
+	if node.Init != nil {
+		self.stmt(node.Init)
+	}
+
+	top := self.here()
+	exit := -1
+	if node.Cond != nil {
+		self.expr(node.Cond)
+		exit = self.emit(JUMP_IF_FALSE, 0, node.Cond.Pos())
+	}
+
+	l := self.openLoop()
+	self.block(node.Body)
+	cont := self.here()
+	if node.Post != nil {
+		self.stmt(node.Post)
+	}
+	self.emit(JUMP, top, node.For)
+	if exit >= 0 {
+		self.patch(exit)
+	}
+	self.closeLoop(l, cont)
+}
+
+func (self *Compiler) rangeStmt(node *ast.RangeStmt) {
+	if len(node.KeyValue) != 2 {
+		self.error(node.For, "range expects a key and a value variable")
+	}
+	key, ok := node.KeyValue[0].(*ast.Ident)
+	if !ok {
+		self.error(node.KeyValue[0].Pos(), "range key must be an identifier")
+	}
+	val, ok := node.KeyValue[1].(*ast.Ident)
+	if !ok {
+		self.error(node.KeyValue[1].Pos(), "range value must be an identifier")
+	}
+
+	self.expr(node.X)
+	slot := self.temp()
+	self.emit(ITER, slot, node.X.Pos())
+
+	top := self.here()
+	self.emit(FOR_ITER, slot, node.For)
+	exit := self.emit(JUMP_IF_FALSE, 0, node.For)
+	self.fresh(val)
+	self.fresh(key)
+	self.store(val)
+	self.store(key)
+
+	l := self.openLoop()
+	self.block(node.Body)
+	self.emit(JUMP, top, node.For)
+	self.patch(exit)
+	self.closeLoop(l, top)
+	self.release(slot)
+}
+
+// fresh gives a captured variable of a range a new cell for every
+// iteration.
+func (self *Compiler) fresh(node *ast.Ident) {
+	if ref := node.Ref; ref != nil && ref.Depth == 0 && self.fs.proto.Captured[ref.Slot] {
+		self.emit(FRESH_CELL, ref.Slot, node.NamePos)
+	}
+}
+
+// tryStmt installs a handler around the body. The finally block is
+// compiled on every way out: after the body or the catch block, on
+// an error, and before a return, break or continue leaving the try.
+func (self *Compiler) tryStmt(node *ast.TryStmt) {
+	handler := self.emit(TRY, 0, node.Try)
+	self.fs.trys = append(self.fs.trys, node.Finally)
+	self.block(node.Body)
+	self.fs.trys = self.fs.trys[:len(self.fs.trys)-1]
+	self.emit(END_TRY, 0, node.Try)
+	if node.Finally != nil {
+		self.block(node.Finally)
+	}
+	ends := []int{self.emit(JUMP, 0, node.Try)}
+
+	// the error is on the stack
+	self.patch(handler)
+	if node.Handler != nil {
+		inner := -1
+		if node.Finally != nil {
+			inner = self.emit(TRY, 0, node.Catch)
+			self.fs.trys = append(self.fs.trys, node.Finally)
+		}
+		if node.Err != nil {
+			self.store(node.Err)
+		} else {
+			self.emit(POP, 1, node.Catch)
+		}
+		self.block(node.Handler)
+		if node.Finally != nil {
+			self.fs.trys = self.fs.trys[:len(self.fs.trys)-1]
+			self.emit(END_TRY, 0, node.Catch)
+			self.block(node.Finally)
+		}
+		ends = append(ends, self.emit(JUMP, 0, node.Try))
+		if inner >= 0 {
+			self.patch(inner)
+			self.reraiseAfter(node.Finally)
+		}
+	} else {
+		self.reraiseAfter(node.Finally)
+	}
+
+	for _, pc := range ends {
+		self.patch(pc)
+	}
+}
+
+// reraiseAfter runs a finally block for the error on the stack and
+// raises the error again.
+func (self *Compiler) reraiseAfter(finally *ast.BlockStmt) {
+	slot := self.temp()
+	self.emit(STORE_LOCAL, slot, finally.Lbrace)
+	self.block(finally)
+	self.emit(LOAD_LOCAL, slot, finally.Lbrace)
+	self.emit(RERAISE, 0, finally.Lbrace)
+	self.release(slot)
+}
@@ -0,0 +1,163 @@
+package compile
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// Disasm writes a listing of proto and of the functions nested in
+// it. The listing only depends on the source, not on where the file
+// is, so it can be kept as the expected output of a script.
+func Disasm(w io.Writer, fset *token.FileSet, proto *Proto) {
+	d := &disasm{w, fset}
+	d.proto(proto.Name, proto)
+}
+
+type disasm struct {
+	w    io.Writer
+	fset *token.FileSet
+}
+
+func (self *disasm) printf(format string, args ...interface{}) {
+	fmt.Fprintf(self.w, format, args...)
+}
+
+func (self *disasm) line(pos token.Pos) int {
+	if !pos.IsValid() {
+		return 0
+	}
+	return self.fset.Position(pos).Line
+}
+
+func (self *disasm) proto(path string, proto *Proto) {
+	line := 0
+	if len(proto.Pos) > 0 {
+		line = self.line(proto.Pos[0])
+	}
+	self.printf("function %s (params %d, locals %d, upvals %d) line %d\n",
+		path, proto.NumParams, len(proto.Locals), len(proto.Upvals), line)
+
+	if len(proto.Consts) > 0 {
+		self.printf("consts:\n")
+		for i, obj := range proto.Consts {
+			self.printf("  %4d  %s\n", i, constString(obj))
+		}
+	}
+	if len(proto.Locals) > 0 {
+		self.printf("locals:\n")
+		for i, name := range proto.Locals {
+			if proto.Captured[i] {
+				self.printf("  %4d  %s captured\n", i, localName(name))
+			} else {
+				self.printf("  %4d  %s\n", i, localName(name))
+			}
+		}
+	}
+	if len(proto.Upvals) > 0 {
+		self.printf("upvals:\n")
+		for i, up := range proto.Upvals {
+			where := "upval"
+			if up.Local {
+				where = "local"
+			}
+			self.printf("  %4d  %s %s %d\n", i, up.Name, where, up.Index)
+		}
+	}
+	if len(proto.Names) > 0 {
+		self.printf("names:\n")
+		for i, name := range proto.Names {
+			self.printf("  %4d  %s\n", i, name)
+		}
+	}
+
+	self.printf("code:\n")
+	last := -1
+	for pc, in := range proto.Code {
+		lineCol := "     "
+		if line := self.line(proto.Pos[pc]); line != last {
+			lineCol = fmt.Sprintf("%5d", line)
+			last = line
+		}
+		operand, note := self.operand(proto, in)
+		if note != "" {
+			self.printf("%s  %04d  %-15s %-8s ; %s\n", lineCol, pc, in.Op(), operand, note)
+		} else if operand != "" {
+			self.printf("%s  %04d  %-15s %s\n", lineCol, pc, in.Op(), operand)
+		} else {
+			self.printf("%s  %04d  %s\n", lineCol, pc, in.Op())
+		}
+	}
+
+	for _, p := range proto.Protos {
+		self.printf("\n")
+		self.proto(path+"."+p.Name, p)
+	}
+}
+
+// operand formats the operand of in and says what it refers to.
+func (self *disasm) operand(proto *Proto, in Instr) (string, string) {
+	arg := in.Arg()
+	switch in.Op() {
+	case NOP, POP_RESULTS, LOAD_NIL, LOAD_TRUE, LOAD_FALSE, GET_INDEX, SET_INDEX,
+		INC, DEC, RETURN_RESULTS, RETURN_SAVED, END_TRY, RERAISE:
+		return "", ""
+	case LOAD_CONST:
+		return strconv.Itoa(arg), constString(proto.Consts[arg])
+	case LOAD_LOCAL, STORE_LOCAL, LOAD_CELL, STORE_CELL, FRESH_CELL, ITER, FOR_ITER:
+		return strconv.Itoa(arg), localName(proto.Locals[arg])
+	case LOAD_UPVAL, STORE_UPVAL:
+		return strconv.Itoa(arg), proto.Upvals[arg].Name
+	case LOAD_GLOBAL, STORE_GLOBAL, GET_PROP, SET_PROP:
+		return strconv.Itoa(arg), proto.Names[arg]
+	case UNARY, BINARY, INPLACE:
+		return strconv.Itoa(arg), token.Tokens[arg]
+	case CLOSURE:
+		return strconv.Itoa(arg), proto.Protos[arg].Name
+	case SLICE:
+		note := "x["
+		if arg&1 != 0 {
+			note += "low"
+		}
+		note += ":"
+		if arg&2 != 0 {
+			note += "high"
+		}
+		return strconv.Itoa(arg), note + "]"
+	case CALL:
+		return fmt.Sprintf("%s %s", count(in.A()), count(in.B())), ""
+	case DEFER, SAVE_RESULTS:
+		return count(arg), ""
+	case JUMP, JUMP_IF_FALSE, TRY:
+		return fmt.Sprintf("-> %04d", arg), ""
+	}
+	return strconv.Itoa(arg), ""
+}
+
+// count formats a count of values, which may be Multi.
+func count(n int) string {
+	if n == Multi {
+		return "all"
+	}
+	return strconv.Itoa(n)
+}
+
+func localName(name string) string {
+	if name == "" {
+		return "<temp>"
+	}
+	return name
+}
+
+func constString(obj rt.Object) string {
+	switch v := obj.(type) {
+	case *rt.StringObject:
+		return strconv.Quote(v.Val)
+	case *rt.RuneObject:
+		return strconv.QuoteRune(v.Val)
+	}
+	return obj.String()
+}
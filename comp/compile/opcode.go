@@ -0,0 +1,161 @@
+package compile
+
+import (
+	"fmt"
+)
+
+type Opcode uint8
+
+const (
+	NOP Opcode = iota
+
+	// stack
+	POP         // pop A values
+	POP_RESULTS // pop the values left by a call with all results
+
+	// loads and stores
+	LOAD_CONST  // push Consts[A]
+	LOAD_NIL    // push nil
+	LOAD_TRUE   // push true
+	LOAD_FALSE  // push false
+	LOAD_LOCAL  // push local A
+	STORE_LOCAL // pop into local A
+	LOAD_CELL   // push the captured local A
+	STORE_CELL  // pop into the captured local A
+	FRESH_CELL  // give the captured local A a new cell
+	LOAD_UPVAL  // push upvalue A of the running closure
+	STORE_UPVAL // pop into upvalue A of the running closure
+	LOAD_GLOBAL // push global Names[A], falling back to a builtin
+	STORE_GLOBAL
+
+	// objects
+	GET_PROP  // x -> x.Names[A]
+	SET_PROP  // val x -> ; x.Names[A] = val
+	GET_INDEX // x i -> x[i]
+	SET_INDEX // val x i -> ; x[i] = val
+	SLICE     // x [low] [high] -> x[low:high], A&1 low and A&2 high given
+
+	// operators, A is the token of the operator
+	UNARY
+	BINARY
+	INPLACE // val x -> y, y is the value of x after x op= val
+	INC     // x -> x+1
+	DEC     // x -> x-1
+
+	// constructors
+	ARRAY   // pop A elements
+	SET     // pop A elements
+	DICT    // pop A key, value pairs
+	CLOSURE // push a closure of Protos[A]
+
+	// calls
+	CALL           // fn args -> results, A args and B results
+	RESULTS        // take the top A values as the results of a call
+	UNPACK         // check that the previous call gave A results
+	RETURN         // return A values
+	RETURN_RESULTS // return the values left by a call with all results
+	SAVE_RESULTS   // keep A values as the pending return
+	RETURN_SAVED   // return the pending values
+	DEFER          // fn args -> ; call when returning, A args
+
+	// control flow
+	JUMP          // jump to A
+	JUMP_IF_FALSE // pop a condition, jump to A if it is false
+	ITER          // x -> ; local A = iterator over x
+	FOR_ITER      // push key, value and true from iterator A, or false when done
+	TRY           // install a handler at A
+	END_TRY       // remove the last handler
+	RERAISE       // pop an error and raise it again
+)
+
+var opNames = [...]string{
+	NOP:            "NOP",
+	POP:            "POP",
+	POP_RESULTS:    "POP_RESULTS",
+	LOAD_CONST:     "LOAD_CONST",
+	LOAD_NIL:       "LOAD_NIL",
+	LOAD_TRUE:      "LOAD_TRUE",
+	LOAD_FALSE:     "LOAD_FALSE",
+	LOAD_LOCAL:     "LOAD_LOCAL",
+	STORE_LOCAL:    "STORE_LOCAL",
+	LOAD_CELL:      "LOAD_CELL",
+	STORE_CELL:     "STORE_CELL",
+	FRESH_CELL:     "FRESH_CELL",
+	LOAD_UPVAL:     "LOAD_UPVAL",
+	STORE_UPVAL:    "STORE_UPVAL",
+	LOAD_GLOBAL:    "LOAD_GLOBAL",
+	STORE_GLOBAL:   "STORE_GLOBAL",
+	GET_PROP:       "GET_PROP",
+	SET_PROP:       "SET_PROP",
+	GET_INDEX:      "GET_INDEX",
+	SET_INDEX:      "SET_INDEX",
+	SLICE:          "SLICE",
+	UNARY:          "UNARY",
+	BINARY:         "BINARY",
+	INPLACE:        "INPLACE",
+	INC:            "INC",
+	DEC:            "DEC",
+	ARRAY:          "ARRAY",
+	SET:            "SET",
+	DICT:           "DICT",
+	CLOSURE:        "CLOSURE",
+	CALL:           "CALL",
+	RESULTS:        "RESULTS",
+	UNPACK:         "UNPACK",
+	RETURN:         "RETURN",
+	RETURN_RESULTS: "RETURN_RESULTS",
+	SAVE_RESULTS:   "SAVE_RESULTS",
+	RETURN_SAVED:   "RETURN_SAVED",
+	DEFER:          "DEFER",
+	JUMP:           "JUMP",
+	JUMP_IF_FALSE:  "JUMP_IF_FALSE",
+	ITER:           "ITER",
+	FOR_ITER:       "FOR_ITER",
+	TRY:            "TRY",
+	END_TRY:        "END_TRY",
+	RERAISE:        "RERAISE",
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", op)
+}
+
+// Instr is an instruction: the opcode in the low 8 bits and a 24 bit
+// operand A, which some instructions split into A and B of 12 bits.
+type Instr uint32
+
+const (
+	MaxArg  = 1<<24 - 1
+	MaxArgB = 1<<12 - 1
+
+	// Multi as the count of arguments or results of CALL, DEFER
+	// and SAVE_RESULTS means all the results of the previous call.
+	Multi = MaxArgB
+)
+
+func MakeInstr(op Opcode, a int) Instr {
+	return Instr(uint32(op) | uint32(a)<<8)
+}
+
+func MakeInstrAB(op Opcode, a, b int) Instr {
+	return MakeInstr(op, a|b<<12)
+}
+
+func (i Instr) Op() Opcode {
+	return Opcode(i & 0xff)
+}
+
+func (i Instr) Arg() int {
+	return int(i >> 8)
+}
+
+func (i Instr) A() int {
+	return int(i>>8) & MaxArgB
+}
+
+func (i Instr) B() int {
+	return int(i >> 20)
+}
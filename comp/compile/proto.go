@@ -0,0 +1,48 @@
+package compile
+
+import (
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// Proto is a compiled function. The script itself compiles to the
+// proto named main, whose variables are globals.
+type Proto struct {
+	Name      string
+	NumParams int
+
+	// Locals names the local slots, parameters first. Temporaries
+	// the compiler needs have empty names.
+	Locals []string
+	// Captured marks the locals closures refer to; they live in
+	// cells shared with the closures.
+	Captured []bool
+	// Upvals tells a new closure of this proto where to find the
+	// cells it refers to.
+	Upvals []Upval
+
+	Consts []rt.Object
+	Names  []string // globals and properties
+	Protos []*Proto // nested functions
+
+	Code []Instr
+	Pos  []token.Pos // source position of each instruction
+}
+
+// Upval is a captured variable: a captured local of the enclosing
+// function when Local is set, or else one of its upvalues.
+type Upval struct {
+	Name  string
+	Local bool
+	Index int
+}
+
+// Error is a construct the compiler refuses.
+type Error struct {
+	Pos token.Position `json:"pos"`
+	Msg string         `json:"message"`
+}
+
+func (self *Error) Error() string {
+	return self.Pos.String() + ": " + self.Msg
+}
@@ -0,0 +1,50 @@
+package comp
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jxwr/doubi/token"
+)
+
+type Severity int
+
+const (
+	Error   Severity = iota // the script is wrong
+	Warning                 // the script is likely wrong
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Diagnostic is a mistake found in a script before it runs. Code
+// names the kind of mistake, such as "undefined" or "unused-var".
+type Diagnostic struct {
+	Pos      token.Position `json:"pos"`
+	Severity Severity       `json:"severity"`
+	Code     string         `json:"code"`
+	Message  string         `json:"message"`
+}
+
+func (self *Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s: %s", self.Pos, self.Severity, self.Message)
+}
+
+// SortDiagnostics orders diags by file and position.
+func SortDiagnostics(diags []*Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i].Pos, diags[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Offset < b.Offset
+	})
+}
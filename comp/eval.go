@@ -2,13 +2,9 @@ package comp
 
 import (
 	"fmt"
-	"os"
 	"reflect"
-	"strconv"
-	"strings"
 
 	"github.com/jxwr/doubi/ast"
-	"github.com/jxwr/doubi/env"
 	"github.com/jxwr/doubi/rt"
 	"github.com/jxwr/doubi/token"
 )
@@ -41,16 +37,100 @@ func (self *Stack) Pop() rt.Object {
 }
 
 type Eval struct {
-	Debug bool
-	E     *env.Env
-	Stack *Stack
-	Fun   *ast.FuncDeclExpr
-	RT    *rt.Runtime
+	Debug   bool
+	Globals map[string]rt.Object
+	Stack   *Stack
+	RT      *rt.Runtime
+	act     *activation
 
 	NeedReturn   bool
 	LoopDepth    int
 	NeedBreak    bool
 	NeedContinue bool
+
+	Fset    *token.FileSet
+	pos     token.Pos // position of the operation being evaluated
+	frames  []frame
+	results []rt.Object // values of the pending return
+}
+
+// activation holds the variables of the running function, laid out
+// by comp.Attr.
+type activation struct {
+	fn     *rt.FuncObject // nil at the top level
+	locals []rt.Object
+	cells  []*rt.Cell // cells of the captured locals
+}
+
+// frame is an active function call.
+type frame struct {
+	name   string
+	call   token.Pos // call site in the caller
+	defers []deferred
+}
+
+// deferred is a call registered by a defer statement, with its
+// arguments already evaluated.
+type deferred struct {
+	fn   *rt.FuncObject
+	args []rt.Object
+	site token.Pos
+}
+
+func NewEval(fset *token.FileSet) *Eval {
+	eval := &Eval{Globals: map[string]rt.Object{}, Stack: NewStack(), Fset: fset}
+	eval.RT = &rt.Runtime{eval.callObject}
+	return eval
+}
+
+// Run evaluates a script resolved by Attr.Script. A runtime error
+// stops the evaluation and is returned as a *rt.RuntimeError carrying
+// the doubi call stack; the globals are kept for the next script.
+func (self *Eval) Run(script *ast.FuncDeclExpr) (err error) {
+	self.act = newActivation(nil, script, nil)
+	act := self.act
+	self.frames = self.frames[:0]
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = self.recoverError(r)
+			self.act = act
+			self.Stack.cur = 0
+			self.NeedReturn = false
+			self.results = nil
+			self.LoopDepth = 0
+			self.NeedBreak = false
+			self.NeedContinue = false
+		}
+	}()
+
+	self.invoke("main", token.NoPos, func() {
+		for _, stmt := range script.Body.List {
+			stmt.Accept(self)
+		}
+	})
+	return nil
+}
+
+// recoverError turns a recovered panic into a RuntimeError and, the
+// first time it is seen, attaches the position and the call stack.
+func (self *Eval) recoverError(r interface{}) *rt.RuntimeError {
+	err, ok := r.(*rt.RuntimeError)
+	if !ok {
+		err = rt.NewRuntimeError(rt.InternalError, "%v", r)
+	}
+	if err.Stack != nil {
+		return err
+	}
+
+	err.Pos = self.Fset.Position(self.pos)
+	pos := self.pos
+	for i := len(self.frames) - 1; i >= 0; i-- {
+		f := self.frames[i]
+		err.Stack = append(err.Stack, rt.StackFrame{f.name, self.Fset.Position(pos)})
+		pos = f.call
+	}
+	return err
 }
 
 func (self *Eval) log(fmtstr string, args ...interface{}) {
@@ -58,10 +138,87 @@ func (self *Eval) log(fmtstr string, args ...interface{}) {
 	fmt.Println()
 }
 
-func (self *Eval) fatal(fmtstr string, args ...interface{}) {
-	fmt.Printf(fmtstr, args...)
-	fmt.Println()
-	os.Exit(1)
+// raise aborts evaluation with a runtime error located at pos.
+func (self *Eval) raise(pos token.Pos, kind, fmtstr string, args ...interface{}) {
+	self.pos = pos
+	rt.Raise(kind, fmtstr, args...)
+}
+
+// truth returns the value of a condition, which must be a bool.
+func (self *Eval) truth(pos token.Pos, obj rt.Object) bool {
+	b, ok := obj.(*rt.BoolObject)
+	if !ok {
+		self.raise(pos, rt.TypeError, "non-bool %s used as condition", obj.Name())
+	}
+	return b.Val
+}
+
+/// variables
+
+func newActivation(fn *rt.FuncObject, decl *ast.FuncDeclExpr, args []rt.Object) *activation {
+	act := &activation{fn, make([]rt.Object, len(decl.Locals)), nil}
+	copy(act.locals, args)
+	for i, captured := range decl.Captured {
+		if captured {
+			if act.cells == nil {
+				act.cells = make([]*rt.Cell, len(decl.Locals))
+			}
+			act.cells[i] = &rt.Cell{act.locals[i]}
+		}
+	}
+	return act
+}
+
+// lookup returns the value of a variable, nil when it is unset.
+func (self *Eval) lookup(node *ast.Ident) rt.Object {
+	ref := node.Ref
+	switch {
+	case ref == nil:
+		return self.Globals[node.Name]
+	case ref.Depth > 0:
+		return self.act.fn.Upvals[ref.Slot].Val
+	case self.act.cells != nil && self.act.cells[ref.Slot] != nil:
+		return self.act.cells[ref.Slot].Val
+	}
+	return self.act.locals[ref.Slot]
+}
+
+func (self *Eval) assign(node *ast.Ident, obj rt.Object) {
+	ref := node.Ref
+	switch {
+	case ref == nil:
+		if node.Name != "_" {
+			self.Globals[node.Name] = obj
+		}
+	case ref.Depth > 0:
+		self.act.fn.Upvals[ref.Slot].Val = obj
+	case self.act.cells != nil && self.act.cells[ref.Slot] != nil:
+		self.act.cells[ref.Slot].Val = obj
+	default:
+		self.act.locals[ref.Slot] = obj
+	}
+}
+
+// fresh gives a captured local a new cell, so that the closures made
+// in an iteration of a loop keep the variables of that iteration.
+func (self *Eval) fresh(node *ast.Ident) {
+	if ref := node.Ref; ref != nil && ref.Depth == 0 && self.act.cells != nil && self.act.cells[ref.Slot] != nil {
+		self.act.cells[ref.Slot] = &rt.Cell{}
+	}
+}
+
+// closure makes a function value of node, which shares the cells of
+// the outer variables it uses.
+func (self *Eval) closure(name string, node *ast.FuncDeclExpr) *rt.FuncObject {
+	upvals := make([]*rt.Cell, len(node.Upvals))
+	for i, up := range node.Upvals {
+		if up.Ref.Depth == 0 {
+			upvals[i] = self.act.cells[up.Ref.Slot]
+		} else {
+			upvals[i] = self.act.fn.Upvals[up.Ref.Slot]
+		}
+	}
+	return rt.NewFuncObject(name, node, upvals).(*rt.FuncObject)
 }
 
 func (self *Eval) evalExpr(expr ast.Expr) {
@@ -76,6 +233,12 @@ func (self *Eval) debug(node interface{}) {
 
 // exprs
 
+func (self *Eval) VisitBadExpr(node *ast.BadExpr) {
+	self.debug(node)
+
+	self.raise(node.From, rt.InternalError, "bad expression")
+}
+
 func (self *Eval) VisitIdent(node *ast.Ident) {
 	self.debug(node)
 
@@ -85,12 +248,14 @@ func (self *Eval) VisitIdent(node *ast.Ident) {
 	} else if node.Name == "false" {
 		obj := rt.NewBoolObject(false)
 		self.Stack.Push(obj)
+	} else if node.Name == "nil" {
+		self.Stack.Push(rt.Nil)
 	} else {
-		obj, _ := self.E.LookUp(node.Name)
+		obj := self.lookup(node)
 		if obj != nil {
-			self.Stack.Push(obj.(rt.Object))
+			self.Stack.Push(obj)
 		} else {
-			panic(node.Name + " not found")
+			self.raise(node.NamePos, rt.NameError, "'%s' is not defined", node.Name)
 		}
 	}
 }
@@ -98,30 +263,11 @@ func (self *Eval) VisitIdent(node *ast.Ident) {
 func (self *Eval) VisitBasicLit(node *ast.BasicLit) {
 	self.debug(node)
 
-	switch node.Kind {
-	case token.INT:
-		val, err := strconv.Atoi(node.Value)
-		if err != nil {
-			self.fatal("%s convert to int failed: %v", node.Value, err)
-		}
-		obj := rt.NewIntegerObject(val)
-		self.Stack.Push(obj)
-	case token.FLOAT:
-		val, err := strconv.ParseFloat(node.Value, 64)
-		if err != nil {
-			self.fatal("%s convert to float failed: %v", node.Value, err)
-		}
-		obj := rt.NewFloatObject(val)
-		self.Stack.Push(obj)
-	case token.STRING:
-		val := strings.Trim(node.Value, "\"")
-		obj := rt.NewStringObject(val)
-		self.Stack.Push(obj)
-	case token.CHAR:
-		val := strings.Trim(node.Value, "'")
-		obj := rt.NewStringObject(val)
-		self.Stack.Push(obj)
+	obj, err := rt.ParseLit(node.Kind, node.Value)
+	if err != nil {
+		self.raise(node.ValuePos, rt.ValueError, "%v", err)
 	}
+	self.Stack.Push(obj)
 }
 
 func (self *Eval) VisitParenExpr(node *ast.ParenExpr) {
@@ -136,6 +282,7 @@ func (self *Eval) VisitSelectorExpr(node *ast.SelectorExpr) {
 	self.evalExpr(node.X)
 	obj := self.Stack.Pop()
 	prop := rt.NewStringObject(node.Sel.Name)
+	self.pos = node.Sel.NamePos
 	rets := obj.Dispatch(self.RT, "__get_property__", prop)
 	self.Stack.Push(rets[0])
 }
@@ -147,6 +294,7 @@ func (self *Eval) VisitIndexExpr(node *ast.IndexExpr) {
 	obj := self.Stack.Pop()
 	self.evalExpr(node.Index)
 	index := self.Stack.Pop()
+	self.pos = node.Lbrack
 	rets := obj.Dispatch(self.RT, "__get_index__", index)
 	self.Stack.Push(rets[0])
 }
@@ -169,73 +317,177 @@ func (self *Eval) VisitSliceExpr(node *ast.SliceExpr) {
 		highObj = self.Stack.Pop()
 	}
 
+	self.pos = node.Lbrack
 	rets := obj.Dispatch(self.RT, "__slice__", lowObj, highObj)
 	self.Stack.Push(rets[0])
 }
 
 func (self *Eval) VisitCallExpr(node *ast.CallExpr) {
-	var fnobj *rt.FuncObject
-	ident, ok := node.Fun.(*ast.Ident)
-
-	var val interface{}
-	if ok {
-		val, _ = self.E.LookUp(ident.Name)
-	}
-	if ok && val == nil {
-		_, exist := rt.Builtins[ident.Name]
-		if exist {
-			fnobj = rt.NewFuncObject(ident.Name, nil, self.E).(*rt.FuncObject)
-			args := []rt.Object{}
-			for _, arg := range node.Args {
-				self.evalExpr(arg)
-				args = append(args, self.Stack.Pop())
-			}
-			self.E = env.NewEnv(self.E)
-			fnobj.E = self.E
-			rets := fnobj.Dispatch(self.RT, "__call__", args...)
-			self.E = self.E.Outer
-			for _, ret := range rets {
-				self.Stack.Push(ret)
-			}
+	self.debug(node)
+
+	rets := self.callResults(node)
+	switch len(rets) {
+	case 1:
+		self.Stack.Push(rets[0])
+	default:
+		self.raise(node.Lparen, rt.ValueError, "multiple-value %s() (%d values) in single-value context",
+			funcName(node), len(rets))
+	}
+}
+
+// callResults evaluates a call and returns all of its results.
+func (self *Eval) callResults(node *ast.CallExpr) []rt.Object {
+	fnobj := self.callee(node)
+	return self.call(fnobj, self.args(node), node.Lparen)
+}
+
+// values evaluates exprs to one value each. A single call spreads all
+// of its results, so f(g()) and a, b = g() see every value of g.
+func (self *Eval) values(exprs []ast.Expr) []rt.Object {
+	if len(exprs) == 1 {
+		if call, ok := exprs[0].(*ast.CallExpr); ok {
+			return self.callResults(call)
 		}
-	} else {
-		self.evalExpr(node.Fun)
-		fnobj = self.Stack.Pop().(*rt.FuncObject)
-
-		if fnobj.IsBuiltin {
-			args := []rt.Object{}
-			for _, arg := range node.Args {
-				self.evalExpr(arg)
-				args = append(args, self.Stack.Pop())
-			}
-			self.E = env.NewEnv(self.E)
-			fnobj.E = self.E
-			rets := fnobj.Dispatch(self.RT, "__call__", args...)
-			self.E = self.E.Outer
-			for _, ret := range rets {
-				self.Stack.Push(ret)
-			}
-		} else {
-			fnDecl := fnobj.Decl
-			fnBak := self.Fun
-			self.Fun = fnDecl
-
-			newEnv := env.NewEnv(fnobj.E)
-			for i, arg := range node.Args {
-				self.evalExpr(arg)
-				newEnv.Put(fnDecl.Args[i].Name, self.Stack.Pop())
+	}
+
+	vals := []rt.Object{}
+	for _, expr := range exprs {
+		self.evalExpr(expr)
+		vals = append(vals, self.Stack.Pop())
+	}
+	return vals
+}
+
+func (self *Eval) args(node *ast.CallExpr) []rt.Object {
+	return self.values(node.Args)
+}
+
+func funcName(node *ast.CallExpr) string {
+	switch fun := node.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name
+	case *ast.SelectorExpr:
+		return fun.Sel.Name
+	}
+	return "function"
+}
+
+// callee evaluates the function of a call. A builtin is looked up by
+// name when nothing in scope shadows it.
+func (self *Eval) callee(node *ast.CallExpr) *rt.FuncObject {
+	if ident, ok := node.Fun.(*ast.Ident); ok {
+		if self.lookup(ident) == nil {
+			if _, exist := rt.Builtins[ident.Name]; !exist {
+				self.raise(ident.NamePos, rt.NameError, "'%s' is not defined", ident.Name)
 			}
+			return rt.NewFuncObject(ident.Name, nil, nil).(*rt.FuncObject)
+		}
+	}
 
-			bakEnv := self.E
-			self.E = newEnv
-			self.NeedReturn = false
-			fnobj.E = self.E
-			fnDecl.Body.Accept(self)
-			self.NeedReturn = false
+	self.evalExpr(node.Fun)
+	obj := self.Stack.Pop()
+	fnobj, ok := obj.(*rt.FuncObject)
+	if !ok {
+		self.raise(node.Lparen, rt.TypeError, "%s is not callable", obj.Name())
+	}
+	return fnobj
+}
+
+// callObject calls a function value for a builtin, such as times.
+func (self *Eval) callObject(fn rt.Object, args ...rt.Object) []rt.Object {
+	fnobj, ok := fn.(*rt.FuncObject)
+	if !ok {
+		self.raise(self.pos, rt.TypeError, "%s is not callable", fn.Name())
+	}
+	return self.call(fnobj, args, self.pos)
+}
+
+// call invokes fnobj with evaluated arguments at the call site and
+// returns its results, which are never empty: a call without results
+// gives nil.
+func (self *Eval) call(fnobj *rt.FuncObject, args []rt.Object, site token.Pos) []rt.Object {
+	if fnobj.Decl == nil {
+		// builtin function or method
+		self.pos = site
+		rets := fnobj.Dispatch(self.RT, "__call__", args...)
+		if len(rets) == 0 {
+			rets = []rt.Object{rt.Nil}
+		}
+		return rets
+	}
+
+	fnDecl := fnobj.Decl
+	if len(args) != len(fnDecl.Args) {
+		self.raise(site, rt.ArgumentError, "%s expects %d argument(s), got %d",
+			fnobj.String(), len(fnDecl.Args), len(args))
+	}
+
+	act := newActivation(fnobj, fnDecl, args)
+	bakAct := self.act
+	bakResults := self.results
+	sp := self.Stack.cur
+
+	var rets []rt.Object
+	self.invoke(fnobj.String(), site, func() {
+		self.act = act
+		self.NeedReturn = false
+		self.results = nil
+		fnDecl.Body.Accept(self)
+		rets = self.results
+		if !self.NeedReturn {
+			// a function falling off its end returns nil
+			rets = nil
+		}
+	})
+	self.NeedReturn = false
+
+	self.act = bakAct
+	self.results = bakResults
+	self.Stack.cur = sp
+	if len(rets) == 0 {
+		rets = []rt.Object{rt.Nil}
+	}
+	return rets
+}
 
-			self.Fun = fnBak
-			self.E = bakEnv
+// invoke runs body in a new frame. The calls deferred in the frame
+// run when body is done, also when it is unwinding with an error.
+func (self *Eval) invoke(name string, call token.Pos, body func()) {
+	if len(self.frames) >= rt.MaxCallDepth {
+		self.raise(call, rt.RecursionError, "maximum recursion depth exceeded")
+	}
+	self.frames = append(self.frames, frame{name, call, nil})
+	depth := len(self.frames)
+	loop, sp := self.LoopDepth, self.Stack.cur
+
+	done := false
+	defer func() {
+		if done || len(self.frames[depth-1].defers) == 0 {
+			return
 		}
+		err := self.recoverError(recover())
+		self.frames = self.frames[:depth]
+		self.LoopDepth, self.Stack.cur = loop, sp
+		self.runDefers(depth - 1)
+		panic(err)
+	}()
+
+	body()
+	self.runDefers(depth - 1)
+	done = true
+	self.frames = self.frames[:depth-1]
+}
+
+// runDefers runs the calls deferred in frame i, the latest first.
+func (self *Eval) runDefers(i int) {
+	for len(self.frames[i].defers) > 0 {
+		f := &self.frames[i]
+		d := f.defers[len(f.defers)-1]
+		f.defers = f.defers[:len(f.defers)-1]
+
+		needReturn := self.NeedReturn
+		self.call(d.fn, d.args, d.site)
+		self.NeedReturn = needReturn
 	}
 }
 
@@ -243,8 +495,16 @@ func (self *Eval) VisitUnaryExpr(node *ast.UnaryExpr) {
 	self.debug(node)
 
 	self.evalExpr(node.X)
-	obj := self.Stack.Pop().(*rt.IntegerObject)
-	self.Stack.Push(rt.NewIntegerObject(-obj.Val))
+	switch obj := self.Stack.Pop().(type) {
+	case *rt.IntegerObject:
+		self.Stack.Push(obj.Neg())
+	case *rt.BigIntObject:
+		self.Stack.Push(obj.Neg())
+	case *rt.FloatObject:
+		self.Stack.Push(rt.NewFloatObject(-obj.Val))
+	default:
+		self.raise(node.OpPos, rt.TypeError, "unsupported operation: %s%s", token.Tokens[node.Op], obj.Name())
+	}
 }
 
 var OpFuncs = map[token.Token]string{
@@ -289,6 +549,12 @@ func (self *Eval) VisitBinaryExpr(node *ast.BinaryExpr) {
 	robj := self.Stack.Pop()
 	lobj := self.Stack.Pop()
 
+	// any value can be compared with nil
+	if robj == rt.Nil && (node.Op == token.EQL || node.Op == token.NEQ) {
+		lobj, robj = robj, lobj
+	}
+
+	self.pos = node.OpPos
 	objs := lobj.Dispatch(self.RT, OpFuncs[node.Op], robj)
 	self.Stack.Push(objs[0])
 }
@@ -336,19 +602,31 @@ func (self *Eval) VisitFuncDeclExpr(node *ast.FuncDeclExpr) {
 	self.debug(node)
 
 	if node.Name != nil {
-		fname := node.Name.Name
-		self.E.Put(fname, rt.NewFuncObject(fname, node, self.E))
+		self.assign(node.Name, self.closure(node.Name.Name, node))
 	} else {
-		self.Stack.Push(rt.NewFuncObject("#<closure>", node, self.E))
+		self.Stack.Push(self.closure("#<closure>", node))
 	}
 }
 
 // stmts
 
+func (self *Eval) VisitBadStmt(node *ast.BadStmt) {
+	self.debug(node)
+
+	self.raise(node.From, rt.InternalError, "bad statement")
+}
+
 func (self *Eval) VisitExprStmt(node *ast.ExprStmt) {
 	self.debug(node)
 
+	if call, ok := node.X.(*ast.CallExpr); ok {
+		self.callResults(call)
+		return
+	}
+
+	sp := self.Stack.cur
 	node.X.Accept(self)
+	self.Stack.cur = sp
 }
 
 func (self *Eval) VisitSendStmt(node *ast.SendStmt) {
@@ -358,87 +636,138 @@ func (self *Eval) VisitSendStmt(node *ast.SendStmt) {
 func (self *Eval) VisitIncDecStmt(node *ast.IncDecStmt) {
 	self.debug(node)
 
-	self.evalExpr(node.X)
-	obj := self.Stack.Pop()
-
 	if node.Tok == token.INC {
-		obj.Dispatch(self.RT, "__inc__")
+		self.update(node.X, node.TokPos, "__inc__")
 	} else if node.Tok == token.DEC {
-		obj.Dispatch(self.RT, "__dec__")
-	}
-}
-
-func ContainsString(ss []string, s string) bool {
-	found := false
-	for _, v := range ss {
-		if v == s {
-			found = true
-			break
-		}
+		self.update(node.X, node.TokPos, "__dec__")
 	}
-	return found
 }
 
 func (self *Eval) VisitAssignStmt(node *ast.AssignStmt) {
 	self.debug(node)
 
-	if node.Tok == token.ASSIGN {
-		for i := 0; i < len(node.Lhs); i++ {
-			self.evalExpr(node.Rhs[i])
-			robj := self.Stack.Pop()
+	// all values are evaluated before any is assigned: a, b = b, a
+	vals := self.values(node.Rhs)
+	self.checkCount(node.TokPos, len(node.Lhs), node.Rhs, vals)
 
+	if node.Tok == token.ASSIGN || node.Tok == token.DEFINE {
+		for i, robj := range vals {
 			switch v := node.Lhs[i].(type) {
 			case *ast.Ident:
-				// closure
-				val, env := self.E.LookUp(v.Name)
-				if val == nil {
-					self.E.Put(v.Name, robj)
-				} else if self.Fun != nil && ContainsString(self.Fun.LocalNames, v.Name) && env != self.E {
-					self.E.Put(v.Name, robj)
-				} else {
-					env.Put(v.Name, robj)
+				if v.Name == "_" {
+					continue
+				}
+				if node.Tok == token.DEFINE {
+					self.fresh(v)
 				}
+				self.assign(v, robj)
 			case *ast.IndexExpr:
 				self.evalExpr(v.X)
 				lobj := self.Stack.Pop()
 				self.evalExpr(v.Index)
 				idx := self.Stack.Pop()
+				self.pos = v.Lbrack
 				lobj.Dispatch(self.RT, "__set_index__", idx, robj)
 			case *ast.SelectorExpr:
 				self.evalExpr(v.X)
 				lobj := self.Stack.Pop()
 				sel := rt.NewStringObject(v.Sel.Name)
+				self.pos = v.Sel.NamePos
 				lobj.Dispatch(self.RT, "__set_property__", sel, robj)
+			default:
+				self.raise(v.Pos(), rt.TypeError, "cannot assign to expression")
 			}
 		}
 	} else {
-		for i := 0; i < len(node.Lhs); i++ {
-			self.evalExpr(node.Rhs[i])
-			robj := self.Stack.Pop()
+		for i, robj := range vals {
+			self.update(node.Lhs[i], node.TokPos, OpFuncs[node.Tok], robj)
+		}
+	}
+}
 
-			switch v := node.Lhs[i].(type) {
-			case *ast.Ident:
-				val, _ := self.E.LookUp(v.Name)
-				val.(rt.Object).Dispatch(self.RT, OpFuncs[node.Tok], robj)
-			case *ast.IndexExpr:
-				// a[b] += c
-				self.evalExpr(v.X)
-				lobj := self.Stack.Pop()
-				self.evalExpr(v.Index)
-				idx := self.Stack.Pop()
-				rets := lobj.Dispatch(self.RT, "__get_index__", idx)
-				rets[0].Dispatch(self.RT, OpFuncs[node.Tok], robj)
-			case *ast.SelectorExpr:
-				self.evalExpr(v.X)
-				lobj := self.Stack.Pop()
-				sel := rt.NewStringObject(v.Sel.Name)
-				rets := lobj.Dispatch(self.RT, "__get_property__", sel)
-				rets[0].Dispatch(self.RT, OpFuncs[node.Tok], robj)
-			}
+// update sets lhs to the result of method, which implements x op= y
+// or x++, on its value. The parts of lhs are evaluated once.
+func (self *Eval) update(lhs ast.Expr, pos token.Pos, method string, args ...rt.Object) {
+	switch v := lhs.(type) {
+	case *ast.Ident:
+		val := self.lookup(v)
+		if val == nil {
+			self.raise(v.NamePos, rt.NameError, "'%s' is not defined", v.Name)
+		}
+		self.pos = pos
+		self.assign(v, rt.Inplace(self.RT, val, method, args...))
+	case *ast.IndexExpr:
+		// a[b] += c
+		self.evalExpr(v.X)
+		lobj := self.Stack.Pop()
+		self.evalExpr(v.Index)
+		idx := self.Stack.Pop()
+		self.pos = v.Lbrack
+		val := lobj.Dispatch(self.RT, "__get_index__", idx)[0]
+		self.pos = pos
+		val = rt.Inplace(self.RT, val, method, args...)
+		self.pos = v.Lbrack
+		lobj.Dispatch(self.RT, "__set_index__", idx, val)
+	case *ast.SelectorExpr:
+		self.evalExpr(v.X)
+		lobj := self.Stack.Pop()
+		sel := rt.NewStringObject(v.Sel.Name)
+		self.pos = v.Sel.NamePos
+		val := lobj.Dispatch(self.RT, "__get_property__", sel)[0]
+		self.pos = pos
+		val = rt.Inplace(self.RT, val, method, args...)
+		self.pos = v.Sel.NamePos
+		lobj.Dispatch(self.RT, "__set_property__", sel, val)
+	default:
+		self.raise(v.Pos(), rt.TypeError, "cannot assign to expression")
+	}
+}
+
+// checkCount raises an error when n variables are assigned the
+// values vals of rhs.
+func (self *Eval) checkCount(pos token.Pos, n int, rhs []ast.Expr, vals []rt.Object) {
+	if n == len(vals) {
+		return
+	}
+	if len(rhs) == 1 {
+		if call, ok := rhs[0].(*ast.CallExpr); ok {
+			self.raise(pos, rt.ValueError, "assignment mismatch: %d variable(s) but %s() returns %d value(s)",
+				n, funcName(call), len(vals))
+		}
+	}
+	self.raise(pos, rt.ValueError, "assignment mismatch: %d variable(s) but %d value(s)", n, len(vals))
+}
+
+func (self *Eval) VisitDeclStmt(node *ast.DeclStmt) {
+	self.debug(node)
+
+	vals := make([]rt.Object, len(node.Names))
+	if len(node.Values) > 0 {
+		vals = self.values(node.Values)
+		self.checkCount(node.TokPos, len(node.Names), node.Values, vals)
+	}
+	for i, name := range node.Names {
+		if name.Name == "_" {
+			continue
+		}
+		if vals[i] == nil {
+			vals[i] = rt.Nil
 		}
+		self.fresh(name)
+		self.assign(name, vals[i])
 	}
 }
 
+func (self *Eval) VisitDeferStmt(node *ast.DeferStmt) {
+	self.debug(node)
+
+	fnobj := self.callee(node.Call)
+	args := self.args(node.Call)
+
+	f := &self.frames[len(self.frames)-1]
+	f.defers = append(f.defers, deferred{fnobj, args, node.Call.Lparen})
+}
+
 func (self *Eval) VisitGoStmt(node *ast.GoStmt) {
 	self.debug(node)
 
@@ -448,10 +777,7 @@ func (self *Eval) VisitGoStmt(node *ast.GoStmt) {
 func (self *Eval) VisitReturnStmt(node *ast.ReturnStmt) {
 	self.debug(node)
 
-	for _, res := range node.Results {
-		self.evalExpr(res)
-	}
-
+	self.results = self.values(node.Results)
 	self.NeedReturn = true
 }
 
@@ -469,7 +795,6 @@ func (self *Eval) VisitBranchStmt(node *ast.BranchStmt) {
 }
 
 func (self *Eval) VisitBlockStmt(node *ast.BlockStmt) {
-	self.E = env.NewEnv(self.E)
 	for _, stmt := range node.List {
 		// need break in all loop
 		if self.NeedReturn {
@@ -483,7 +808,6 @@ func (self *Eval) VisitBlockStmt(node *ast.BlockStmt) {
 		}
 		stmt.Accept(self)
 	}
-	self.E = self.E.Outer
 }
 
 func (self *Eval) VisitIfStmt(node *ast.IfStmt) {
@@ -492,7 +816,7 @@ func (self *Eval) VisitIfStmt(node *ast.IfStmt) {
 	self.evalExpr(node.Cond)
 	cond := self.Stack.Pop()
 
-	if cond.(*rt.BoolObject).Val {
+	if self.truth(node.Cond.Pos(), cond) {
 		node.Body.Accept(self)
 	} else if node.Else != nil {
 		node.Else.Accept(self)
@@ -511,14 +835,15 @@ func (self *Eval) VisitCaseClause(node *ast.CaseClause) {
 			self.evalExpr(e)
 			if ok {
 				v := self.Stack.Pop()
+				self.pos = e.Pos()
 				rets := initObj.Dispatch(self.RT, "__eql__", v)
-				if rets[0].(*rt.BoolObject).Val == false {
+				if !self.truth(e.Pos(), rets[0]) {
 					self.Stack.Push(rt.NewBoolObject(false))
 					return
 				}
 			} else {
-				v := self.Stack.Pop().(*rt.BoolObject)
-				if v.Val == false {
+				v := self.Stack.Pop()
+				if !self.truth(e.Pos(), v) {
 					self.Stack.Push(rt.NewBoolObject(false))
 					return
 				}
@@ -546,7 +871,11 @@ func (self *Eval) VisitCaseClause(node *ast.CaseClause) {
 func (self *Eval) VisitSwitchStmt(node *ast.SwitchStmt) {
 	self.debug(node)
 
-	node.Init.Accept(self)
+	tag, ok := node.Init.(*ast.ExprStmt)
+	if !ok {
+		self.raise(node.Init.Pos(), rt.TypeError, "switch expects an expression")
+	}
+	self.evalExpr(tag.X)
 	initObj := self.Stack.Pop()
 	for _, c := range node.Body.List {
 		self.Stack.Push(initObj)
@@ -572,7 +901,7 @@ func (self *Eval) VisitForStmt(node *ast.ForStmt) {
 	for {
 		self.evalExpr(node.Cond)
 		cond := self.Stack.Pop()
-		if !cond.(*rt.BoolObject).Val {
+		if !self.truth(node.Cond.Pos(), cond) {
 			break
 		}
 
@@ -602,16 +931,25 @@ func (self *Eval) VisitRangeStmt(node *ast.RangeStmt) {
 	self.evalExpr(node.X)
 	obj := self.Stack.Pop()
 
-	keyName := node.KeyValue[0].(*ast.Ident).Name
-	valName := node.KeyValue[1].(*ast.Ident).Name
-
-	self.E = env.NewEnv(self.E)
+	if len(node.KeyValue) != 2 {
+		self.raise(node.For, rt.ValueError, "range expects a key and a value variable")
+	}
+	keyIdent, ok := node.KeyValue[0].(*ast.Ident)
+	if !ok {
+		self.raise(node.KeyValue[0].Pos(), rt.TypeError, "range key must be an identifier")
+	}
+	valIdent, ok := node.KeyValue[1].(*ast.Ident)
+	if !ok {
+		self.raise(node.KeyValue[1].Pos(), rt.TypeError, "range value must be an identifier")
+	}
 
 	switch v := obj.(type) {
 	case *rt.ArrayObject:
 		for i, val := range v.Vals {
-			self.E.Put(keyName, rt.NewIntegerObject(i))
-			self.E.Put(valName, val)
+			self.fresh(keyIdent)
+			self.fresh(valIdent)
+			self.assign(keyIdent, rt.NewIntegerObject(i))
+			self.assign(valIdent, val)
 
 			self.LoopDepth++
 			node.Body.Accept(self)
@@ -630,8 +968,34 @@ func (self *Eval) VisitRangeStmt(node *ast.RangeStmt) {
 		}
 	case *rt.SetObject:
 		for i, val := range v.Vals {
-			self.E.Put(keyName, rt.NewIntegerObject(i))
-			self.E.Put(valName, val)
+			self.fresh(keyIdent)
+			self.fresh(valIdent)
+			self.assign(keyIdent, rt.NewIntegerObject(i))
+			self.assign(valIdent, val)
+
+			self.LoopDepth++
+			node.Body.Accept(self)
+			self.LoopDepth--
+
+			if self.NeedReturn {
+				break
+			}
+			if self.NeedBreak {
+				self.NeedBreak = false
+				break
+			}
+			if self.NeedContinue {
+				self.NeedContinue = false
+			}
+		}
+	case *rt.StringObject:
+		i := 0
+		for _, r := range v.Val {
+			self.fresh(keyIdent)
+			self.fresh(valIdent)
+			self.assign(keyIdent, rt.NewIntegerObject(i))
+			self.assign(valIdent, rt.NewRuneObject(r))
+			i++
 
 			self.LoopDepth++
 			node.Body.Accept(self)
@@ -650,8 +1014,10 @@ func (self *Eval) VisitRangeStmt(node *ast.RangeStmt) {
 		}
 	case *rt.DictObject:
 		for i, val := range v.Property {
-			self.E.Put(keyName, rt.NewStringObject(i))
-			self.E.Put(valName, val)
+			self.fresh(keyIdent)
+			self.fresh(valIdent)
+			self.assign(keyIdent, rt.NewStringObject(i))
+			self.assign(valIdent, val)
 
 			self.LoopDepth++
 			node.Body.Accept(self)
@@ -668,7 +1034,64 @@ func (self *Eval) VisitRangeStmt(node *ast.RangeStmt) {
 				self.NeedContinue = false
 			}
 		}
+	default:
+		self.raise(node.X.Pos(), rt.TypeError, "cannot range over %s", obj.Name())
 	}
+}
+
+// protect evaluates block and recovers a runtime error raised inside
+// it, putting the evaluator back into the state it had on entry.
+func (self *Eval) protect(block *ast.BlockStmt) (err *rt.RuntimeError) {
+	act, depth, loop, sp := self.act, len(self.frames), self.LoopDepth, self.Stack.cur
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = self.recoverError(r)
+			self.act = act
+			self.frames = self.frames[:depth]
+			self.LoopDepth = loop
+			self.Stack.cur = sp
+		}
+	}()
+
+	block.Accept(self)
+	return nil
+}
+
+func (self *Eval) VisitTryStmt(node *ast.TryStmt) {
+	self.debug(node)
 
-	self.E = self.E.Outer
+	err := self.protect(node.Body)
+
+	if err != nil && node.Handler != nil {
+		if node.Err != nil {
+			self.assign(node.Err, rt.NewErrorObject(err))
+		}
+		if node.Finally != nil {
+			err = self.protect(node.Handler)
+		} else {
+			err = nil
+			node.Handler.Accept(self)
+		}
+	}
+
+	if node.Finally != nil {
+		// a pending return, break or continue waits for the finally
+		// block, unless the finally block jumps itself
+		needReturn, needBreak, needContinue := self.NeedReturn, self.NeedBreak, self.NeedContinue
+		results := self.results
+		self.NeedReturn, self.NeedBreak, self.NeedContinue = false, false, false
+
+		node.Finally.Accept(self)
+
+		if self.NeedReturn || self.NeedBreak || self.NeedContinue {
+			return
+		}
+		self.NeedReturn, self.NeedBreak, self.NeedContinue = needReturn, needBreak, needContinue
+		self.results = results
+	}
+
+	if err != nil {
+		panic(err)
+	}
 }
@@ -2,37 +2,130 @@ package comp
 
 import (
 	"fmt"
+	"io"
+	"strings"
 
 	"github.com/jxwr/doubi/ast"
 	"github.com/jxwr/doubi/token"
 )
 
+// PrettyPrinter writes statements back as source, in the layout of
+// doubi fmt: one statement per line, blocks indented by four spaces,
+// spaces around binary operators and after commas. Array, set and
+// dict literals that span lines in the source get one element per
+// line. The comments it is given are written back where they were,
+// on lines of their own or at the end of a line, and at most one
+// blank line is kept between statements.
 type PrettyPrinter struct {
-	Debug       bool
-	Indent      int
-	ShowNewLine bool
+	Debug  bool
+	Indent int
+
+	w         io.Writer
+	fset      *token.FileSet
+	comments  []*ast.Comment // the comments not written yet
+	lineStart bool
+	err       error
 }
 
-func puts(str string) {
-	fmt.Print(str)
+func NewPrettyPrinter(w io.Writer, fset *token.FileSet, comments []*ast.Comment) *PrettyPrinter {
+	return &PrettyPrinter{false, 0, w, fset, comments, true, nil}
 }
 
-func putTok(tok token.Token) {
-	puts(" ")
-	puts(token.Tokens[tok])
-	puts(" ")
+// Format writes file in the layout of doubi fmt.
+func Format(w io.Writer, fset *token.FileSet, file *ast.File) error {
+	p := NewPrettyPrinter(w, fset, file.Comments)
+	last := p.stmtList(file.Stmts, 0)
+	p.ownLineComments(token.Pos(1<<31-1), last)
+	return p.err
+}
+
+func (self *PrettyPrinter) write(str string) {
+	if self.err == nil {
+		_, self.err = io.WriteString(self.w, str)
+	}
+}
+
+func (self *PrettyPrinter) puts(str string) {
+	if str == "" {
+		return
+	}
+	self.indent()
+	self.write(str)
+}
+
+// indent writes the indentation of a line not started yet.
+func (self *PrettyPrinter) indent() {
+	if self.lineStart {
+		self.write(strings.Repeat("    ", self.Indent))
+		self.lineStart = false
+	}
+}
+
+func (self *PrettyPrinter) putTok(tok token.Token) {
+	self.puts(" ")
+	self.puts(token.Tokens[tok])
+	self.puts(" ")
 }
 
 func (self *PrettyPrinter) putln() {
-	if self.ShowNewLine {
-		fmt.Println()
+	self.write("\n")
+	self.lineStart = true
+}
+
+// putList writes a list separated by commas. A list split after a
+// comma in the source is split there too, its later lines indented,
+// so that the comments at the end of its lines stay where they are.
+func (self *PrettyPrinter) putList(nodes []ast.Expr) {
+	if len(nodes) == 0 {
+		return
+	}
+	pos := func(i int) token.Pos { return nodes[i].Pos() }
+	end := func(i int) token.Pos { return nodes[i].End() }
+	elem := func(i int) { nodes[i].Accept(self) }
+	split := false
+	for i := 1; i < len(nodes); i++ {
+		split = split || self.line(pos(i)) > self.line(end(i-1)-1)
 	}
+	if split {
+		self.indent()
+		self.Indent++
+		defer func() { self.Indent-- }()
+	}
+	self.items(len(nodes), pos, end, elem, self.line(pos(0)))
+}
+
+// items writes the n items of a list separated by commas. Items that
+// start a line in the source start a line, after the comments at the
+// end of the line before. last is the line before the first item,
+// and the line of the last one is returned.
+func (self *PrettyPrinter) items(n int, pos, end func(int) token.Pos, elem func(int), last int) int {
+	for i := 0; i < n; i++ {
+		if self.line(pos(i)) > last {
+			self.lineComments(last)
+			self.putln()
+			self.ownLineComments(pos(i), last)
+		} else if i > 0 {
+			self.puts(" ")
+		}
+		elem(i)
+		if i < n-1 {
+			self.puts(",")
+		}
+		last = self.line(end(i) - 1)
+	}
+	return last
 }
 
-func (self *PrettyPrinter) putIndent() {
-	for i := 0; i < self.Indent; i++ {
-		puts("  ")
+func (self *PrettyPrinter) line(pos token.Pos) int {
+	if !pos.IsValid() {
+		return 0
 	}
+	return self.fset.Position(pos).Line
+}
+
+// endLine is the line of the last character of node.
+func (self *PrettyPrinter) endLine(node ast.Node) int {
+	return self.line(node.End() - 1)
 }
 
 func (self *PrettyPrinter) debug(node interface{}) {
@@ -41,31 +134,163 @@ func (self *PrettyPrinter) debug(node interface{}) {
 	}
 }
 
+/// comments
+
+// text is a comment without the spaces at the end of its line.
+func text(c *ast.Comment) string {
+	return strings.TrimRight(c.Text, " \t\r")
+}
+
+// ownLineComments writes the comments before pos on lines of their
+// own. last is the line of what was written before them, 0 for the
+// start of a block, and the line of the last comment is returned.
+func (self *PrettyPrinter) ownLineComments(pos token.Pos, last int) int {
+	for len(self.comments) > 0 && self.comments[0].Slash < pos {
+		c := self.comments[0]
+		self.comments = self.comments[1:]
+		line := self.line(c.Slash)
+		if last > 0 && line > last+1 {
+			self.putln()
+		}
+		self.puts(text(c))
+		self.putln()
+		last = line
+	}
+	return last
+}
+
+// lineComments writes the comments up to line at the end of the
+// current line. Comments left inside a statement spanning lines go
+// on lines of their own after it.
+func (self *PrettyPrinter) lineComments(line int) {
+	inner := []*ast.Comment{}
+	for len(self.comments) > 0 && self.line(self.comments[0].Slash) <= line {
+		c := self.comments[0]
+		self.comments = self.comments[1:]
+		if self.line(c.Slash) == line {
+			self.puts(" " + text(c))
+		} else {
+			inner = append(inner, c)
+		}
+	}
+	for _, c := range inner {
+		self.putln()
+		self.puts(text(c))
+	}
+}
+
+func (self *PrettyPrinter) hasCommentsBefore(pos token.Pos) bool {
+	return len(self.comments) > 0 && self.comments[0].Slash < pos
+}
+
+/// stmts
+
+// stmtList writes each statement on a line of its own, and returns
+// the line of the last one. last is the line before the list, 0 at
+// the start of a block.
+func (self *PrettyPrinter) stmtList(list []ast.Stmt, last int) int {
+	for _, stmt := range list {
+		last = self.ownLineComments(stmt.Pos(), last)
+		if last > 0 && self.line(stmt.Pos()) > last+1 {
+			self.putln()
+		}
+		stmt.Accept(self)
+		last = self.endLine(stmt)
+		self.lineComments(last)
+		self.putln()
+	}
+	return last
+}
+
+// body writes the statements of a block or a case, which end at end.
+func (self *PrettyPrinter) body(list []ast.Stmt, open token.Pos, end token.Pos) {
+	self.lineComments(self.line(open))
+	self.putln()
+	self.Indent++
+	last := self.stmtList(list, 0)
+	self.ownLineComments(end, last)
+	self.Indent--
+}
+
+// oneLine reports whether a block is kept on one line: it is on one
+// line in the source and holds at most a simple statement.
+func (self *PrettyPrinter) oneLine(node *ast.BlockStmt) bool {
+	if self.hasCommentsBefore(node.Rbrack) {
+		return false
+	}
+	switch len(node.List) {
+	case 0:
+		return true
+	case 1:
+		switch node.List[0].(type) {
+		case *ast.ExprStmt, *ast.AssignStmt, *ast.DeclStmt, *ast.IncDecStmt,
+			*ast.ReturnStmt, *ast.BranchStmt, *ast.DeferStmt, *ast.GoStmt, *ast.SendStmt:
+			return self.line(node.Lbrace) == self.line(node.Rbrack)
+		}
+	}
+	return false
+}
+
+// elems writes the n elements of a literal, laid out as items does.
+// A dict gets a comma before a closing brace on a line of its own.
+// An array or a set can only close on a line of its own when it
+// opens with one.
+func (self *PrettyPrinter) elems(open string, n int, pos, end func(int) token.Pos, elem func(int),
+	lbrack, rbrack token.Pos, close string, dict bool) {
+	self.puts(open)
+	if n == 0 {
+		self.puts(close)
+		return
+	}
+
+	self.Indent++
+	last := self.items(n, pos, end, elem, self.line(lbrack))
+	self.Indent--
+
+	if self.line(rbrack) > last && (dict || self.line(pos(0)) > self.line(lbrack)) {
+		if dict {
+			self.puts(",")
+		}
+		self.lineComments(last)
+		self.putln()
+		self.ownLineComments(rbrack, last)
+	}
+	self.puts(close)
+}
+
+/// exprs
+
+func (self *PrettyPrinter) VisitBadExpr(node *ast.BadExpr) {
+	self.debug(node)
+
+	self.puts("BadExpr")
+}
+
 func (self *PrettyPrinter) VisitIdent(node *ast.Ident) {
 	self.debug(node)
 
-	puts(node.Name)
+	self.puts(node.Name)
 }
 
 func (self *PrettyPrinter) VisitBasicLit(node *ast.BasicLit) {
 	self.debug(node)
 
-	puts(node.Value)
+	self.puts(node.Value)
 }
 
 func (self *PrettyPrinter) VisitParenExpr(node *ast.ParenExpr) {
 	self.debug(node)
 
-	puts("(")
+	self.puts("(")
 	node.X.Accept(self)
-	puts(")")
+	self.puts(")")
 }
 
 func (self *PrettyPrinter) VisitSelectorExpr(node *ast.SelectorExpr) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	puts(".")
+	self.puts(".")
 	node.Sel.Accept(self)
 }
 
@@ -73,43 +298,62 @@ func (self *PrettyPrinter) VisitIndexExpr(node *ast.IndexExpr) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	puts("[")
+	self.puts("[")
 	node.Index.Accept(self)
-	puts("]")
+	self.puts("]")
 }
 
 func (self *PrettyPrinter) VisitSliceExpr(node *ast.SliceExpr) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	puts("[")
-	node.Low.Accept(self)
-	puts(":")
-	node.High.Accept(self)
-	puts("]")
+	self.puts("[")
+	if node.Low != nil {
+		node.Low.Accept(self)
+	}
+	self.puts(":")
+	if node.High != nil {
+		node.High.Accept(self)
+	}
+	self.puts("]")
 }
 
 func (self *PrettyPrinter) VisitCallExpr(node *ast.CallExpr) {
 	self.debug(node)
 
 	node.Fun.Accept(self)
-	puts("(")
-	for i, arg := range node.Args {
-		self.ShowNewLine = false
-		arg.Accept(self)
-		self.ShowNewLine = true
-		if i < len(node.Args)-1 {
-			puts(", ")
-		}
+	self.puts("(")
+	self.putList(node.Args)
+	self.puts(")")
+}
+
+// startsWithMinus reports whether node is written starting with -,
+// which must not follow another - as that would be --.
+func startsWithMinus(node ast.Expr) bool {
+	switch n := node.(type) {
+	case *ast.UnaryExpr:
+		return true
+	case *ast.BinaryExpr:
+		return startsWithMinus(n.X)
+	case *ast.SelectorExpr:
+		return startsWithMinus(n.X)
+	case *ast.IndexExpr:
+		return startsWithMinus(n.X)
+	case *ast.SliceExpr:
+		return startsWithMinus(n.X)
+	case *ast.CallExpr:
+		return startsWithMinus(n.Fun)
 	}
-	puts(")")
-
+	return false
 }
 
 func (self *PrettyPrinter) VisitUnaryExpr(node *ast.UnaryExpr) {
 	self.debug(node)
 
-	putTok(node.Op)
+	self.puts(token.Tokens[node.Op])
+	if startsWithMinus(node.X) {
+		self.puts(" ")
+	}
 	node.X.Accept(self)
 }
 
@@ -117,252 +361,280 @@ func (self *PrettyPrinter) VisitBinaryExpr(node *ast.BinaryExpr) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	putTok(node.Op)
+	self.putTok(node.Op)
 	node.Y.Accept(self)
 }
 
 func (self *PrettyPrinter) VisitArrayExpr(node *ast.ArrayExpr) {
 	self.debug(node)
 
-	puts("[")
-	for i, elem := range node.Elems {
-		elem.Accept(self)
-		if i < len(node.Elems)-1 {
-			puts(", ")
-		}
-	}
-	puts("]")
+	pos := func(i int) token.Pos { return node.Elems[i].Pos() }
+	end := func(i int) token.Pos { return node.Elems[i].End() }
+	elem := func(i int) { node.Elems[i].Accept(self) }
+	self.elems("[", len(node.Elems), pos, end, elem, node.Lbrack, node.Rbrack, "]", false)
 }
 
 func (self *PrettyPrinter) VisitSetExpr(node *ast.SetExpr) {
 	self.debug(node)
 
-	puts("#[")
-	for i, elem := range node.Elems {
-		elem.Accept(self)
-		if i < len(node.Elems)-1 {
-			puts(", ")
-		}
-	}
-	puts("]")
+	pos := func(i int) token.Pos { return node.Elems[i].Pos() }
+	end := func(i int) token.Pos { return node.Elems[i].End() }
+	elem := func(i int) { node.Elems[i].Accept(self) }
+	self.elems("#[", len(node.Elems), pos, end, elem, node.Lbrack, node.Rbrack, "]", false)
 }
 
 func (self *PrettyPrinter) VisitDictExpr(node *ast.DictExpr) {
 	self.debug(node)
-	puts("#{")
-	for i, field := range node.Fields {
-		field.Name.Accept(self)
-		puts(":")
-		field.Value.Accept(self)
 
-		if i < len(node.Fields)-1 {
-			puts(", ")
-		}
+	pos := func(i int) token.Pos { return node.Fields[i].Name.Pos() }
+	end := func(i int) token.Pos { return node.Fields[i].End() }
+	elem := func(i int) {
+		node.Fields[i].Name.Accept(self)
+		self.puts(": ")
+		node.Fields[i].Value.Accept(self)
 	}
-	puts("}")
+	self.elems("#{", len(node.Fields), pos, end, elem, node.Lbrace, node.Rbrace, "}", true)
 }
 
 func (self *PrettyPrinter) VisitFuncDeclExpr(node *ast.FuncDeclExpr) {
 	self.debug(node)
 
-	puts("func ")
+	self.puts("func")
 	if node.Recv != nil {
-		puts("(")
+		self.puts(" (")
 		node.Recv.Accept(self)
-		puts(" ")
+		self.puts(" ")
 		node.RecvType.Accept(self)
-		puts(") ")
+		self.puts(")")
 	}
-
 	if node.Name != nil {
+		self.puts(" ")
 		node.Name.Accept(self)
 	}
 
-	puts("(")
+	self.puts("(")
 	for i, arg := range node.Args {
 		arg.Accept(self)
 		if i < len(node.Args)-1 {
-			puts(", ")
+			self.puts(", ")
 		}
 	}
-	puts(") ")
+	self.puts(") ")
 	node.Body.Accept(self)
 }
 
+// stmts
+
+func (self *PrettyPrinter) VisitBadStmt(node *ast.BadStmt) {
+	self.debug(node)
+
+	self.puts("BadStmt")
+}
+
 func (self *PrettyPrinter) VisitExprStmt(node *ast.ExprStmt) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitSendStmt(node *ast.SendStmt) {
 	self.debug(node)
 
 	node.Chan.Accept(self)
-	puts(" <- ")
+	self.puts(" <- ")
 	node.Value.Accept(self)
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitIncDecStmt(node *ast.IncDecStmt) {
 	self.debug(node)
 
 	node.X.Accept(self)
-	putTok(node.Tok)
-	self.putln()
+	self.puts(token.Tokens[node.Tok])
 }
 
 func (self *PrettyPrinter) VisitAssignStmt(node *ast.AssignStmt) {
 	self.debug(node)
 
-	for i, arg := range node.Lhs {
-		arg.Accept(self)
-		if i < len(node.Lhs)-1 {
-			puts(", ")
-		}
+	self.putList(node.Lhs)
+	if len(node.Lhs) > 0 {
+		self.puts(" ")
 	}
+	self.puts(token.Tokens[node.Tok])
+	if len(node.Rhs) > 0 {
+		self.puts(" ")
+	}
+	self.putList(node.Rhs)
+}
 
-	putTok(node.Tok)
+func (self *PrettyPrinter) VisitDeclStmt(node *ast.DeclStmt) {
+	self.debug(node)
 
-	for i, arg := range node.Rhs {
-		arg.Accept(self)
-		if i < len(node.Rhs)-1 {
-			puts(", ")
+	self.puts(token.Tokens[node.Tok])
+	self.puts(" ")
+	for i, name := range node.Names {
+		name.Accept(self)
+		if i < len(node.Names)-1 {
+			self.puts(", ")
 		}
 	}
-	self.putln()
+	if len(node.Values) > 0 {
+		self.putTok(token.ASSIGN)
+		self.putList(node.Values)
+	}
+}
+
+func (self *PrettyPrinter) VisitDeferStmt(node *ast.DeferStmt) {
+	self.debug(node)
+
+	self.puts("defer ")
+	node.Call.Accept(self)
 }
 
 func (self *PrettyPrinter) VisitGoStmt(node *ast.GoStmt) {
 	self.debug(node)
 
-	puts("go ")
+	self.puts("go ")
 	node.Call.Accept(self)
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitReturnStmt(node *ast.ReturnStmt) {
 	self.debug(node)
 
-	puts("return ")
-	for i, ret := range node.Results {
-		ret.Accept(self)
-		if i < len(node.Results)-1 {
-			puts(", ")
-		}
+	self.puts("return")
+	if len(node.Results) > 0 {
+		self.puts(" ")
+		self.putList(node.Results)
 	}
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitBranchStmt(node *ast.BranchStmt) {
 	self.debug(node)
 
-	putTok(node.Tok)
-	self.putln()
+	self.puts(token.Tokens[node.Tok])
 }
 
 func (self *PrettyPrinter) VisitBlockStmt(node *ast.BlockStmt) {
 	self.debug(node)
 
-	nl := self.ShowNewLine
-	puts("{")
-	self.ShowNewLine = true
-	self.putln()
-	self.Indent++
-	for _, stmt := range node.List {
-		self.putIndent()
-		stmt.Accept(self)
+	if self.oneLine(node) {
+		if len(node.List) == 0 {
+			self.puts("{}")
+			return
+		}
+		self.puts("{ ")
+		node.List[0].Accept(self)
+		self.puts(" }")
+		return
 	}
-	self.Indent--
-	self.ShowNewLine = nl
-	self.putIndent()
-	puts("}")
+	self.puts("{")
+	self.body(node.List, node.Lbrace, node.Rbrack)
+	self.puts("}")
 }
 
 func (self *PrettyPrinter) VisitIfStmt(node *ast.IfStmt) {
 	self.debug(node)
 
-	puts("if ")
+	self.puts("if ")
 	node.Cond.Accept(self)
-	puts(" ")
+	self.puts(" ")
 	node.Body.Accept(self)
-
 	if node.Else != nil {
-		puts(" else ")
+		self.puts(" else ")
 		node.Else.Accept(self)
 	}
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitCaseClause(node *ast.CaseClause) {
 	self.debug(node)
 
-	puts("case ")
-	for i, stmt := range node.List {
-		stmt.Accept(self)
-		if i < len(node.List)-1 {
-			puts(", ")
-		}
+	if node.List == nil {
+		self.puts("default:")
+	} else {
+		self.puts("case ")
+		self.putList(node.List)
+		self.puts(":")
 	}
-	puts(":")
+	self.body(node.Body, node.Colon, node.End())
+}
+
+// caseBlock writes the clauses of a switch or a select, which are
+// not indented.
+func (self *PrettyPrinter) caseBlock(node *ast.BlockStmt) {
+	self.puts("{")
+	self.lineComments(self.line(node.Lbrace))
 	self.putln()
-	self.Indent++
-	for _, stmt := range node.Body {
-		self.putIndent()
-		stmt.Accept(self)
+	last := 0
+	for _, clause := range node.List {
+		last = self.ownLineComments(clause.Pos(), last)
+		clause.Accept(self)
+		last = self.endLine(clause)
 	}
-	self.Indent--
+	self.ownLineComments(node.Rbrack, last)
+	self.puts("}")
 }
 
 func (self *PrettyPrinter) VisitSwitchStmt(node *ast.SwitchStmt) {
 	self.debug(node)
 
-	puts("switch ")
-	self.ShowNewLine = false
+	self.puts("switch ")
 	node.Init.Accept(self)
-	self.ShowNewLine = true
-	puts(" ")
-	node.Body.Accept(self)
-	self.putln()
+	self.puts(" ")
+	self.caseBlock(node.Body)
 }
 
 func (self *PrettyPrinter) VisitSelectStmt(node *ast.SelectStmt) {
 	self.debug(node)
 
-	puts("select ")
-	node.Body.Accept(self)
-	self.putln()
+	self.puts("select ")
+	self.caseBlock(node.Body)
 }
 
 func (self *PrettyPrinter) VisitForStmt(node *ast.ForStmt) {
 	self.debug(node)
 
-	puts("for ")
-	self.ShowNewLine = false
-	node.Init.Accept(self)
-	puts("; ")
-	node.Cond.Accept(self)
-	puts("; ")
-	node.Post.Accept(self)
-	puts(" ")
-	self.ShowNewLine = true
+	self.puts("for ")
+	if node.Init == nil && node.Post == nil {
+		node.Cond.Accept(self)
+	} else {
+		if node.Init != nil {
+			node.Init.Accept(self)
+		}
+		self.puts("; ")
+		node.Cond.Accept(self)
+		self.puts("; ")
+		node.Post.Accept(self)
+	}
+	self.puts(" ")
 	node.Body.Accept(self)
-	self.putln()
 }
 
 func (self *PrettyPrinter) VisitRangeStmt(node *ast.RangeStmt) {
 	self.debug(node)
 
-	puts("for ")
-	self.ShowNewLine = false
-	node.KeyValue[0].Accept(self)
-	puts(", ")
-	node.KeyValue[1].Accept(self)
-	puts(" = range ")
+	self.puts("for ")
+	self.putList(node.KeyValue)
+	self.putTok(node.Tok)
+	self.puts("range ")
 	node.X.Accept(self)
-	puts(" ")
-	self.ShowNewLine = true
+	self.puts(" ")
 	node.Body.Accept(self)
-	self.putln()
+}
+
+func (self *PrettyPrinter) VisitTryStmt(node *ast.TryStmt) {
+	self.debug(node)
+
+	self.puts("try ")
+	node.Body.Accept(self)
+	if node.Handler != nil {
+		self.puts(" catch ")
+		if node.Err != nil {
+			node.Err.Accept(self)
+			self.puts(" ")
+		}
+		node.Handler.Accept(self)
+	}
+	if node.Finally != nil {
+		self.puts(" finally ")
+		node.Finally.Accept(self)
+	}
 }
@@ -2,57 +2,373 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/jxwr/doubi/ast"
 	"github.com/jxwr/doubi/comp"
-	"github.com/jxwr/doubi/env"
+	"github.com/jxwr/doubi/comp/compile"
 	"github.com/jxwr/doubi/parser"
 	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+	"github.com/jxwr/doubi/vm"
 )
 
-func Eval(stmts []ast.Stmt) {
-	pretty := &comp.PrettyPrinter{false, 0, true}
-	attr := &comp.Attr{false, env.NewEnv(nil), nil}
-	eval := &comp.Eval{false, env.NewEnv(nil), comp.NewStack(), nil, nil,
-		false, 0, false, false}
+func Eval(stmts []ast.Stmt) error {
+	script, err := resolve(stmts)
+	if err != nil {
+		return err
+	}
 
-	runtime := &rt.Runtime{eval}
-	eval.RT = runtime
+	if engine == "ast" {
+		return comp.NewEval(fset).Run(script)
+	}
 
-	if false {
-		for _, stmt := range stmts {
-			stmt.Accept(pretty)
+	proto, err := compile.NewCompiler(fset).Compile(script)
+	if err != nil {
+		return err
+	}
+	return vm.New(fset).Run(proto)
+}
+
+func runTest(filename string) error {
+	var contents []byte
+	var err error
+
+	if !jsonErrors {
+		fmt.Println("=============> ", filename, " <=============")
+	}
+
+	contents, err = ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if engine != "ast" && useCache {
+		proto, err := load(filename, contents)
+		if err != nil {
+			return err
 		}
+		return vm.New(fset).Run(proto)
 	}
 
-	for _, stmt := range stmts {
-		stmt.Accept(attr)
+	file, err := parser.ParseFile(fset, filename, string(contents))
+	if err != nil {
+		return err
+	}
+	return Eval(file.Stmts)
+}
+
+// resolve finds the variables of a script.
+func resolve(stmts []ast.Stmt) (*ast.FuncDeclExpr, error) {
+	attr := comp.NewAttr(fset)
+	attr.Strict = strict
+	return attr.Script(stmts)
+}
+
+// load compiles a script, reusing its .dc cache when the cache was
+// made from the same source by this version, and otherwise
+// rebuilding it. A cache says nothing about -strict, so strict runs
+// always rebuild.
+func load(filename string, src []byte) (*compile.Proto, error) {
+	if !strict {
+		if proto, err := compile.ReadCache(fset, filename, src); err == nil {
+			return proto, nil
+		}
 	}
 
-	for _, stmt := range stmts {
-		stmt.Accept(eval)
+	file, err := parser.ParseFile(fset, filename, string(src))
+	if err != nil {
+		return nil, err
+	}
+	script, err := resolve(file.Stmts)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := compile.NewCompiler(fset).Compile(script)
+	if err != nil {
+		return nil, err
 	}
 
+	// a script in a read-only place just runs without a cache
+	compile.WriteCache(fset, filename, proto, src)
+	return proto, nil
 }
 
-func runTest(filename string) {
-	var contents []byte
-	var err error
+// disasm prints the bytecode a script compiles to.
+func disasm(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("=============> ", filename, " <=============")
+	file, err := parser.ParseFile(fset, filename, string(contents))
+	if err != nil {
+		return err
+	}
+	script, err := resolve(file.Stmts)
+	if err != nil {
+		return err
+	}
+	proto, err := compile.NewCompiler(fset).Compile(script)
+	if err != nil {
+		return err
+	}
+	compile.Disasm(os.Stdout, fset, proto)
+	return nil
+}
 
-	contents, err = ioutil.ReadFile(filename)
+// tokens prints the tokens of the scripts named in args, or with
+// -bench how fast they are split into tokens.
+func tokens(args []string) bool {
+	flags := flag.NewFlagSet("tokens", flag.ExitOnError)
+	bench := flags.Bool("bench", false, "print how fast the lexer reads the files")
+	min := flags.Float64("min", 0, "with -bench, fail below this many MB/s")
+	flags.Parse(args)
+
+	ok := true
+	for _, filename := range flags.Args() {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			reportError(err)
+			ok = false
+			continue
+		}
+		src := string(contents)
+
+		if !*bench {
+			parser.ScanFile(fset, filename, src, func(t parser.Token) {
+				fmt.Printf("%s\t%s\t%q\n", fset.Position(t.Pos), parser.TokenName(t.Tok), t.Lit)
+			})
+			continue
+		}
+
+		n, ntoks := 0, 0
+		start := time.Now()
+		for time.Since(start) < time.Second {
+			parser.ScanFile(token.NewFileSet(), filename, src, func(parser.Token) { ntoks++ })
+			n++
+		}
+		elapsed := time.Since(start)
+		mbs := float64(n*len(src)) / elapsed.Seconds() / 1e6
+		fmt.Printf("%s: %d bytes, %d tokens, %.1f MB/s, %.0f ns/token\n", filename,
+			len(src), ntoks/n, mbs, float64(elapsed.Nanoseconds())/float64(ntoks))
+		if mbs < *min {
+			fmt.Printf("%s: slower than %.1f MB/s\n", filename, *min)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// check reports the mistakes in scripts without running them, and
+// whether any of them is an error.
+func check(filenames []string) bool {
+	diags := []*comp.Diagnostic{}
+	for _, filename := range filenames {
+		diags = append(diags, checkFile(filename)...)
+	}
+
+	failed := false
+	for _, diag := range diags {
+		if diag.Severity == comp.Error {
+			failed = true
+		}
+	}
+	if jsonErrors {
+		json.NewEncoder(os.Stdout).Encode(diags)
+	} else {
+		for _, diag := range diags {
+			fmt.Printf("%s [%s]\n", diag.Error(), diag.Code)
+		}
+	}
+	return failed
+}
+
+func checkFile(filename string) []*comp.Diagnostic {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		pos := token.Position{Filename: filename}
+		return []*comp.Diagnostic{{pos, comp.Error, "io", err.Error()}}
+	}
+
+	file, err := parser.ParseFile(fset, filename, string(contents))
 	if err != nil {
+		errs, ok := err.(parser.ErrorList)
+		if !ok {
+			errs = parser.ErrorList{err}
+		}
+		diags := []*comp.Diagnostic{}
+		for _, e := range errs {
+			pos := token.Position{Filename: filename}
+			msg := e.Error()
+			if se, ok := e.(*parser.SyntaxError); ok {
+				pos.Line, pos.Column = se.Line, se.Col
+				msg = "syntax error: " + se.Msg
+				if len(se.Expected) > 0 {
+					msg += ", expecting " + strings.Join(se.Expected, " or ")
+				}
+			}
+			diags = append(diags, &comp.Diagnostic{pos, comp.Error, "syntax", msg})
+		}
+		return diags
+	}
+
+	checker := comp.NewChecker(fset)
+	checker.Strict = strict
+	return checker.Check(file.Stmts)
+}
+
+// format lays a script out as doubi fmt does, and makes sure the
+// result parses back to the same program. With partial set, a script
+// with syntax errors is laid out too, as far as it parsed, and
+// returned along with the errors.
+func format(filename string, src []byte, partial bool) ([]byte, error) {
+	fs := token.NewFileSet()
+	file, perr := parser.ParseFile(fs, filename, string(src))
+	if perr != nil && !partial {
+		return nil, perr
+	}
+
+	var buf bytes.Buffer
+	if err := comp.Format(&buf, fs, file); err != nil {
+		return nil, err
+	}
+	if perr != nil {
+		return buf.Bytes(), perr
+	}
+	again, err := parser.ParseFile(token.NewFileSet(), filename, buf.String())
+	if err != nil || !ast.Equal(file.Stmts, again.Stmts) {
+		return nil, fmt.Errorf("%s: formatting would change the program", filename)
+	}
+	return buf.Bytes(), nil
+}
+
+// gofmt formats the scripts named in args, or stdin when there are
+// none, and reports whether all went well.
+func gofmt(args []string) bool {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result to the file instead of stdout")
+	list := flags.Bool("l", false, "list the files whose formatting differs")
+	diff := flags.Bool("d", false, "print diffs instead of the result")
+	partial := flags.Bool("e", false, "print what parsed of scripts with syntax errors")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			src, err = format("<stdin>", src, *partial)
+		}
+		os.Stdout.Write(src)
+		if err != nil {
+			reportError(err)
+			return false
+		}
+		return true
+	}
+
+	ok := true
+	for _, filename := range flags.Args() {
+		if err := fmtFile(filename, *write, *list, *diff, *partial); err != nil {
+			reportError(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func fmtFile(filename string, write, list, diff, partial bool) error {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	res, err := format(filename, src, partial)
+	if err != nil {
+		// what parsed of a broken script is printed, never written back
+		os.Stdout.Write(res)
+		return err
+	}
+
+	if !bytes.Equal(src, res) {
+		if list {
+			fmt.Println(filename)
+		}
+		if write {
+			if err := ioutil.WriteFile(filename, res, 0644); err != nil {
+				return err
+			}
+		}
+		if diff {
+			d, err := diffBytes(filename, src, res)
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(d)
+		}
+	}
+	if !list && !write && !diff {
+		os.Stdout.Write(res)
+	}
+	return nil
+}
+
+// diffBytes runs diff -u on the old and new contents of a file.
+func diffBytes(filename string, old, new []byte) ([]byte, error) {
+	f1, err := ioutil.TempFile("", "doubifmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f1.Name())
+	defer f1.Close()
+	f2, err := ioutil.TempFile("", "doubifmt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f2.Name())
+	defer f2.Close()
+	f1.Write(old)
+	f2.Write(new)
+
+	d, err := exec.Command("diff", "-u", "-L", filename+".orig", "-L", filename, f1.Name(), f2.Name()).Output()
+	if len(d) > 0 {
+		// diff exits with 1 when the files differ
+		err = nil
+	}
+	return d, err
+}
+
+func reportError(err error) {
+	if !jsonErrors {
+		parser.FormatError(os.Stdout, err)
 		return
 	}
 
-	parser.ProgramAst = nil
-	parser.DoubiParse(parser.NewLexer(string(contents)))
-	Eval(parser.ProgramAst)
+	errs, ok := err.(parser.ErrorList)
+	if !ok {
+		errs = parser.ErrorList{err}
+	}
+	out := []interface{}{}
+	for _, e := range errs {
+		if se, ok := e.(*parser.SyntaxError); ok {
+			out = append(out, se)
+		} else if re, ok := e.(*rt.RuntimeError); ok {
+			out = append(out, re)
+		} else if ce, ok := e.(*compile.Error); ok {
+			out = append(out, ce)
+		} else if d, ok := e.(*comp.Diagnostic); ok {
+			out = append(out, d)
+		} else {
+			out = append(out, map[string]string{"message": e.Error()})
+		}
+	}
+	json.NewEncoder(os.Stdout).Encode(out)
 }
 
 func repl() {
@@ -63,8 +379,12 @@ func repl() {
 
 		fmt.Printf("> ")
 		if src, ok = readGist(fi); ok {
-			parser.DoubiParse(&parser.Lexer{Src: src, Line: 1, Pos: 0})
-			Eval(parser.ProgramAst)
+			file, err := parser.ParseFile(fset, "<stdin>", src)
+			if err != nil {
+				reportError(err)
+			} else if err := Eval(file.Stmts); err != nil {
+				reportError(err)
+			}
 		} else {
 			break
 		}
@@ -82,17 +402,68 @@ func readGist(fi *bufio.Reader) (string, bool) {
 }
 
 var input string
+var jsonErrors bool
+var engine string
+var useCache bool
+var strict bool
+
+var fset = token.NewFileSet()
 
 func init() {
 	flag.StringVar(&input, "i", "", "input file")
+	flag.BoolVar(&jsonErrors, "json", false, "report errors as JSON")
+	flag.StringVar(&engine, "engine", "vm", "how to run scripts: vm or ast")
+	flag.BoolVar(&useCache, "cache", true, "reuse and write .dc bytecode caches")
+	flag.BoolVar(&strict, "strict", false, "reject assignments to undeclared variables")
 }
 
 func main() {
 	flag.Parse()
 
-	if input != "" {
-		runTest(input)
-	} else {
-		runTest("test/play.d")
+	if flag.Arg(0) == "fmt" {
+		if !gofmt(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "tokens" {
+		if !tokens(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "check" {
+		files := flag.Args()[1:]
+		if input != "" {
+			files = append(files, input)
+		}
+		if check(files) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "disasm" {
+		files := flag.Args()[1:]
+		if input != "" {
+			files = append(files, input)
+		}
+		for _, filename := range files {
+			if err := disasm(filename); err != nil {
+				reportError(err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if input == "" {
+		input = "test/play.d"
+	}
+	if err := runTest(input); err != nil {
+		reportError(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,81 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type ErrorList []error
+
+func (self ErrorList) Error() string {
+	msgs := []string{}
+	for _, err := range self {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// SyntaxError describes a single parse failure. Line and Col are
+// 1-based and point at the start of the offending token. Excerpt
+// holds the source lines around the error, the first of which is
+// line ExcerptLine.
+type SyntaxError struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Col      int      `json:"col"`
+	Tok      string   `json:"token"`
+	Msg      string   `json:"message"`
+	Expected []string `json:"expected,omitempty"`
+
+	Excerpt     []string `json:"excerpt,omitempty"`
+	ExcerptLine int      `json:"excerpt_line,omitempty"`
+}
+
+func (self *SyntaxError) Error() string {
+	msg := "syntax error: " + self.Msg
+	if len(self.Expected) > 0 {
+		msg += ", expecting " + strings.Join(self.Expected, " or ")
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", self.File, self.Line, self.Col, msg)
+}
+
+// splitMessage breaks a verbose yacc message of the form
+// "syntax error: unexpected X, expecting A or B" into its parts.
+func splitMessage(s string) (msg string, expected []string) {
+	msg = strings.TrimPrefix(s, "syntax error")
+	msg = strings.TrimPrefix(msg, ": ")
+	if i := strings.Index(msg, ", expecting "); i >= 0 {
+		expected = strings.Split(msg[i+len(", expecting "):], " or ")
+		msg = msg[:i]
+	}
+	if msg == "" {
+		msg = "unexpected input"
+	}
+	return
+}
+
+// FormatError writes err to w. Syntax errors are rendered with the
+// nearby source lines and a marker under the offending token; any
+// other error is written as is.
+func FormatError(w io.Writer, err error) {
+	switch e := err.(type) {
+	case ErrorList:
+		for _, err := range e {
+			FormatError(w, err)
+		}
+	case *SyntaxError:
+		fmt.Fprintf(w, "Syntax Error: %s Line:%d Col:%d %s NEARLINES:\n", e.File, e.Line, e.Col, e.Msg)
+		for i, src := range e.Excerpt {
+			line := e.ExcerptLine + i
+			if line == e.Line {
+				fmt.Fprintf(w, "*%3d) %s\n", line, src)
+				fmt.Fprintf(w, "%s^\n", strings.Repeat(" ", e.Col+5))
+			} else {
+				fmt.Fprintf(w, " %3d) %s\n", line, src)
+			}
+		}
+	default:
+		fmt.Fprintln(w, err)
+	}
+}
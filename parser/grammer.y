@@ -7,8 +7,6 @@ import (
        "github.com/jxwr/doubi/token"
 )
 
-var ProgramAst []ast.Stmt
-
 type Tok struct {
     Lit string
     Line int
@@ -20,6 +18,21 @@ func (t Tok) String() string {
     return t.Lit
 }
 
+// badStmt covers the input skipped while recovering from the last
+// syntax error, up to the token the parser resynchronised on.
+func badStmt(l DoubiLexer) ast.Stmt {
+    lex := l.(*Lexer)
+    return &ast.BadStmt{lex.errPos, lex.file.Pos(lex.tokPos)}
+}
+
+// badLine covers an unclosed parenthesis up to the end of its line,
+// where recovery gives up. The EOL goes back to the lexer, so it
+// still ends the statement.
+func badLine(l DoubiLexer, lparen, eol Tok) ast.Expr {
+    l.(*Lexer).unread(eol, EOL)
+    return &ast.BadExpr{lparen.Pos, eol.Pos}
+}
+
 %}
 
 // fields inside this union end up as the fields in a structure known
@@ -42,15 +55,17 @@ func (t Tok) String() string {
 %type <expr_list> expr_list
 %type <field> field_pair
 %type <field_list> field_list
-%type <ident_list> ident_list
+%type <ident_list> ident_list name_list
 
-%type <stmt> stmt expr_stmt send_stmt incdec_stmt assign_stmt go_stmt
+%type <stmt> stmt expr_stmt send_stmt incdec_stmt assign_stmt decl_stmt go_stmt defer_stmt
 %type <stmt> return_stmt branch_stmt block_stmt if_stmt 
 %type <stmt> case_clause case_block switch_stmt select_stmt for_stmt range_stmt
+%type <stmt> try_stmt bad_stmt
 %type <stmt_list> stmt_list case_clause_list prog
+%type <tok> bad_tok
 
 %token <tok> EOF EOL COMMENT
-%token <tok> IDENT INT FLOAT STRING CHAR 
+%token <tok> IDENT INT FLOAT IMAG STRING CHAR 
 %token <tok> SHL SHR AND_NOT 
 %token <tok> ADD_ASSIGN SUB_ASSIGN MUL_ASSIGN QUO_ASSIGN REM_ASSIGN
 %token <tok> AND_ASSIGN OR_ASSIGN XOR_ASSIGN SHL_ASSIGN SHR_ASSIGN AND_NOT_ASSIGN
@@ -60,11 +75,14 @@ func (t Tok) String() string {
 %token <tok> LPAREN LBRACK LBRACE COMMA PERIOD RPAREN RBRACK RBRACE
 %token <tok> SEMICOLON COLON
 
-%token <tok> BREAK CASE CHAN CONTINUE CONST
-%token <tok> DEFAULT DEFER ELSE FALLTHROUGH FOR
+%token <tok> BREAK CASE CATCH CHAN CONTINUE CONST
+%token <tok> DEFAULT DEFER ELSE FALLTHROUGH FINALLY FOR
 %token <tok> FUNC GO GOTO IF IMPORT INTERFACE MAP PACKAGE RANGE RETURN 
-%token <tok> SELECT STRUCT SWITCH TYPE VAR 
+%token <tok> SELECT STRUCT SWITCH TRY TYPE VAR 
 
+// an error right before a closing brace ends the block
+%nonassoc BADSTMT
+%nonassoc RBRACE
 %left LAND LOR ARROW
 %left SHL SHR AND_NOT 
 %left OR
@@ -86,14 +104,17 @@ func (t Tok) String() string {
 
 %%
 
-ident : IDENT				{ $$ = &ast.Ident{$1.Pos, $1.Lit} }
+ident : IDENT				{ $$ = &ast.Ident{$1.Pos, $1.Lit, nil} }
 
 basiclit : INT				{ $$ = &ast.BasicLit{$1.Pos, token.INT, $1.Lit} }
 	 | FLOAT			{ $$ = &ast.BasicLit{$1.Pos, token.FLOAT, $1.Lit} }
+	 | IMAG				{ $$ = &ast.BasicLit{$1.Pos, token.IMAG, $1.Lit} }
 	 | STRING 			{ $$ = &ast.BasicLit{$1.Pos, token.STRING, $1.Lit} }
 	 | CHAR				{ $$ = &ast.BasicLit{$1.Pos, token.CHAR, $1.Lit} }
 
 paren_expr : LPAREN expr RPAREN		{ $$ = &ast.ParenExpr{$1.Pos, $2, $3.Pos} }
+	   | LPAREN error RPAREN	{ $$ = &ast.ParenExpr{$1.Pos, &ast.BadExpr{$1.Pos, $3.Pos}, $3.Pos} }
+	   | LPAREN error EOL		{ $$ = &ast.ParenExpr{$1.Pos, badLine(Doubilex, $1, $3), $3.Pos} }
 
 selector_expr : expr PERIOD ident      	{ $$ = &ast.SelectorExpr{$1, $3.(*ast.Ident)} }
 
@@ -105,54 +126,56 @@ slice_expr : expr LBRACK expr COLON expr RBRACK
 	     { $$ = &ast.SliceExpr{$1, $2.Pos, $3, nil, $5.Pos} }
 
 index_expr : expr LBRACK expr RBRACK    
-	     { $$ = &ast.IndexExpr{$1, $2.Pos, $3, $2.Pos} }
+	     { $$ = &ast.IndexExpr{$1, $2.Pos, $3, $4.Pos} }
 
 expr_list : /* empty */		      	  { $$ = []ast.Expr{} }
 	  | expr			  { $$ = []ast.Expr{$1} }
 	  | expr_list COMMA expr	  { $$ = append($1, $3) }
 	  | expr_list COMMA EOL expr	  { $$ = append($1, $4) }
 
-call_expr : expr LPAREN expr_list RPAREN  { $$ = &ast.CallExpr{$1, 0, $3, 0} }
-
-unary_expr : SUB expr %prec UMINUS	  { $$ = &ast.UnaryExpr{0, token.SUB, $2 } }
-
-binary_expr : expr ADD expr 		  { $$ = &ast.BinaryExpr{$1, 0, token.ADD, $3 } }
-            | expr SUB expr		  { $$ = &ast.BinaryExpr{$1, 0, token.SUB, $3 } }
-            | expr MUL expr		  { $$ = &ast.BinaryExpr{$1, 0, token.MUL, $3 } }
-            | expr QUO expr		  { $$ = &ast.BinaryExpr{$1, 0, token.QUO, $3 } }
-            | expr REM expr		  { $$ = &ast.BinaryExpr{$1, 0, token.REM, $3 } }
-            | expr AND expr		  { $$ = &ast.BinaryExpr{$1, 0, token.AND, $3 } }
-            | expr OR expr		  { $$ = &ast.BinaryExpr{$1, 0, token.OR, $3 } }
-            | expr XOR expr		  { $$ = &ast.BinaryExpr{$1, 0, token.XOR, $3 } }
-            | expr SHL expr		  { $$ = &ast.BinaryExpr{$1, 0, token.SHL, $3 } }
-            | expr SHR expr		  { $$ = &ast.BinaryExpr{$1, 0, token.SHR, $3 } }
-            | expr AND_NOT expr		  { $$ = &ast.BinaryExpr{$1, 0, token.AND_NOT, $3 } }
-            | expr LSS expr		  { $$ = &ast.BinaryExpr{$1, 0, token.LSS, $3 } }
-            | expr GTR expr		  { $$ = &ast.BinaryExpr{$1, 0, token.GTR, $3 } }
-            | expr NEQ expr		  { $$ = &ast.BinaryExpr{$1, 0, token.NEQ, $3 } }
-            | expr LEQ expr		  { $$ = &ast.BinaryExpr{$1, 0, token.LEQ, $3 } }
-            | expr GEQ expr		  { $$ = &ast.BinaryExpr{$1, 0, token.GEQ, $3 } }
-            | expr EQL expr		  { $$ = &ast.BinaryExpr{$1, 0, token.EQL, $3 } }
-
-            | expr LAND expr		  { $$ = &ast.BinaryExpr{$1, 0, token.LAND, $3 } }
-            | expr LOR expr		  { $$ = &ast.BinaryExpr{$1, 0, token.LOR, $3 } }
+call_expr : expr LPAREN expr_list RPAREN  { $$ = &ast.CallExpr{$1, $2.Pos, $3, $4.Pos} }
+	  | expr LPAREN error RPAREN	  { $$ = &ast.CallExpr{$1, $2.Pos, []ast.Expr{&ast.BadExpr{$2.Pos, $4.Pos}}, $4.Pos} }
+	  | expr LPAREN error EOL	  { $$ = &ast.CallExpr{$1, $2.Pos, []ast.Expr{badLine(Doubilex, $2, $4)}, $4.Pos} }
+
+unary_expr : SUB expr %prec UMINUS	  { $$ = &ast.UnaryExpr{$1.Pos, token.SUB, $2 } }
+
+binary_expr : expr ADD expr 		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.ADD, $3 } }
+            | expr SUB expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.SUB, $3 } }
+            | expr MUL expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.MUL, $3 } }
+            | expr QUO expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.QUO, $3 } }
+            | expr REM expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.REM, $3 } }
+            | expr AND expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.AND, $3 } }
+            | expr OR expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.OR, $3 } }
+            | expr XOR expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.XOR, $3 } }
+            | expr SHL expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.SHL, $3 } }
+            | expr SHR expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.SHR, $3 } }
+            | expr AND_NOT expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.AND_NOT, $3 } }
+            | expr LSS expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.LSS, $3 } }
+            | expr GTR expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.GTR, $3 } }
+            | expr NEQ expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.NEQ, $3 } }
+            | expr LEQ expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.LEQ, $3 } }
+            | expr GEQ expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.GEQ, $3 } }
+            | expr EQL expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.EQL, $3 } }
+
+            | expr LAND expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.LAND, $3 } }
+            | expr LOR expr		  { $$ = &ast.BinaryExpr{$1, $2.Pos, token.LOR, $3 } }
 
 array_expr : LBRACK expr_list RBRACK
-	     { $$ = &ast.ArrayExpr{0, $2, 0} }
+	     { $$ = &ast.ArrayExpr{$1.Pos, $2, $3.Pos} }
 	   | LBRACK EOL expr_list EOL RBRACK
-	     { $$ = &ast.ArrayExpr{0, $3, 0} }
+	     { $$ = &ast.ArrayExpr{$1.Pos, $3, $5.Pos} }
 	   | LBRACK EOL expr_list RBRACK
-	     { $$ = &ast.ArrayExpr{0, $3, 0} }
+	     { $$ = &ast.ArrayExpr{$1.Pos, $3, $4.Pos} }
 
 set_expr : '#' LBRACK expr_list RBRACK
-	   { $$ = &ast.SetExpr{0, $3, 0} }
+	   { $$ = &ast.SetExpr{$<tok>1.Pos, $2.Pos, $3, $4.Pos} }
 	 | '#' LBRACK EOL expr_list EOL RBRACK
-	   { $$ = &ast.SetExpr{0, $4, 0} }
+	   { $$ = &ast.SetExpr{$<tok>1.Pos, $2.Pos, $4, $6.Pos} }
 	 | '#' LBRACK EOL expr_list RBRACK
-	   { $$ = &ast.SetExpr{0, $4, 0} }
+	   { $$ = &ast.SetExpr{$<tok>1.Pos, $2.Pos, $4, $5.Pos} }
 
 field_pair : expr COLON expr
-	     { $$ = &ast.Field{$1, 0, $3} }
+	     { $$ = &ast.Field{$1, $2.Pos, $3} }
 
 field_list : /* empty */			    { $$ = []*ast.Field{} } 
 	   | field_pair	     		     	    { $$ = []*ast.Field{$1} } 
@@ -163,22 +186,24 @@ field_list : /* empty */			    { $$ = []*ast.Field{} }
 	   | field_list COMMA EOL	     	    { $$ = $1 }
 
 dict_expr : '#' LBRACE field_list RBRACE
-	    { $$ = &ast.DictExpr{0, $3, 0} }
+	    { $$ = &ast.DictExpr{$<tok>1.Pos, $2.Pos, $3, $4.Pos} }
+
+name_list : IDENT
+	     { $$ = []*ast.Ident{&ast.Ident{$1.Pos, $1.Lit, nil}} }
+	  | name_list COMMA IDENT
+	     { $$ = append($1, &ast.Ident{$3.Pos, $3.Lit, nil}) }
 
 ident_list : /* empty */
    	     { $$ = []*ast.Ident{} }
-	   | IDENT
-	     { $$ = []*ast.Ident{&ast.Ident{0, $1.Lit}} }
-	   | ident_list COMMA IDENT
-	     { $$ = append($1, &ast.Ident{0, $3.Lit}) }
+	   | name_list
 
 func_decl_expr : FUNC LPAREN ident_list RPAREN block_stmt
-                 { $$ = &ast.FuncDeclExpr{0, nil, nil, nil, $3, $5.(*ast.BlockStmt), []string{}} }
+                 { $$ = &ast.FuncDeclExpr{$1.Pos, nil, nil, nil, $3, $5.(*ast.BlockStmt), nil, nil, nil} }
 	       | FUNC IDENT LPAREN ident_list RPAREN block_stmt
-                 { $$ = &ast.FuncDeclExpr{0, nil, nil, &ast.Ident{0, $2.Lit}, $4, $6.(*ast.BlockStmt), []string{}} }
+                 { $$ = &ast.FuncDeclExpr{$1.Pos, nil, nil, &ast.Ident{$2.Pos, $2.Lit, nil}, $4, $6.(*ast.BlockStmt), nil, nil, nil} }
 	       | FUNC LPAREN IDENT IDENT RPAREN IDENT LPAREN ident_list RPAREN block_stmt
-	       	 { $$ = &ast.FuncDeclExpr{0, &ast.Ident{0, $3.Lit}, &ast.Ident{0, $4.Lit},
-                                          &ast.Ident{0, $6.Lit}, $8, $10.(*ast.BlockStmt), []string{}} }
+	       	 { $$ = &ast.FuncDeclExpr{$1.Pos, &ast.Ident{$3.Pos, $3.Lit, nil}, &ast.Ident{$4.Pos, $4.Lit, nil},
+                                          &ast.Ident{$6.Pos, $6.Lit, nil}, $8, $10.(*ast.BlockStmt), nil, nil, nil} }
 
 expr : ident
      | basiclit
@@ -198,66 +223,93 @@ expr : ident
 
 expr_stmt : expr			{ $$ = &ast.ExprStmt{$1} }
 
-send_stmt : expr ARROW expr		{ $$ = &ast.SendStmt{$1, 0, $3} }
-
-incdec_stmt : expr INC 			{ $$ = &ast.IncDecStmt{$1, 0, token.INC} }
-            | expr DEC			{ $$ = &ast.IncDecStmt{$1, 0, token.DEC} }
-
-assign_stmt : expr_list ASSIGN expr_list       		{ $$ = &ast.AssignStmt{$1, 0, token.ASSIGN, $3} }
-	    | expr_list ADD_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.ADD_ASSIGN, $3} }
-	    | expr_list SUB_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.SUB_ASSIGN, $3} }
-	    | expr_list MUL_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.MUL_ASSIGN, $3} }
-	    | expr_list QUO_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.QUO_ASSIGN, $3} }
-	    | expr_list REM_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.REM_ASSIGN, $3} }
-	    | expr_list AND_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.AND_ASSIGN, $3} }
-	    | expr_list OR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.OR_ASSIGN, $3} }
-	    | expr_list XOR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.XOR_ASSIGN, $3} }
-	    | expr_list SHL_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.SHL_ASSIGN, $3} }
-	    | expr_list SHR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, 0, token.SHR_ASSIGN, $3} }
-	    | expr_list AND_NOT_ASSIGN expr_list	{ $$ = &ast.AssignStmt{$1, 0, token.AND_NOT_ASSIGN, $3} }
+send_stmt : expr ARROW expr		{ $$ = &ast.SendStmt{$1, $2.Pos, $3} }
+
+incdec_stmt : expr INC 			{ $$ = &ast.IncDecStmt{$1, $2.Pos, token.INC} }
+            | expr DEC			{ $$ = &ast.IncDecStmt{$1, $2.Pos, token.DEC} }
+
+assign_stmt : expr_list ASSIGN expr_list       		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.ASSIGN, $3} }
+	    | expr_list DEFINE expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.DEFINE, $3} }
+	    | expr_list ADD_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.ADD_ASSIGN, $3} }
+	    | expr_list SUB_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.SUB_ASSIGN, $3} }
+	    | expr_list MUL_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.MUL_ASSIGN, $3} }
+	    | expr_list QUO_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.QUO_ASSIGN, $3} }
+	    | expr_list REM_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.REM_ASSIGN, $3} }
+	    | expr_list AND_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.AND_ASSIGN, $3} }
+	    | expr_list OR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.OR_ASSIGN, $3} }
+	    | expr_list XOR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.XOR_ASSIGN, $3} }
+	    | expr_list SHL_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.SHL_ASSIGN, $3} }
+	    | expr_list SHR_ASSIGN expr_list		{ $$ = &ast.AssignStmt{$1, $2.Pos, token.SHR_ASSIGN, $3} }
+	    | expr_list AND_NOT_ASSIGN expr_list	{ $$ = &ast.AssignStmt{$1, $2.Pos, token.AND_NOT_ASSIGN, $3} }
+
+decl_stmt : VAR name_list
+	    { $$ = &ast.DeclStmt{$1.Pos, token.VAR, $2, nil} }
+	  | VAR name_list ASSIGN expr_list
+	    { $$ = &ast.DeclStmt{$1.Pos, token.VAR, $2, $4} }
+	  | CONST name_list ASSIGN expr_list
+	    { $$ = &ast.DeclStmt{$1.Pos, token.CONST, $2, $4} }
+
+defer_stmt : DEFER call_expr
+	     { $$ = &ast.DeferStmt{$1.Pos, $2.(*ast.CallExpr)} }
 
 go_stmt : GO call_expr
-	  { $$ = &ast.GoStmt{0, $2.(*ast.CallExpr)} }
+	  { $$ = &ast.GoStmt{$1.Pos, $2.(*ast.CallExpr)} }
 
 return_stmt : RETURN expr_list
-	      { $$ = &ast.ReturnStmt{0, $2} }
+	      { $$ = &ast.ReturnStmt{$1.Pos, $2} }
 
-branch_stmt : BREAK				{ $$ = &ast.BranchStmt{0, token.BREAK} }
-	     | CONTINUE				{ $$ = &ast.BranchStmt{0, token.CONTINUE } }
+branch_stmt : BREAK				{ $$ = &ast.BranchStmt{$1.Pos, token.BREAK} }
+	     | CONTINUE				{ $$ = &ast.BranchStmt{$1.Pos, token.CONTINUE } }
 
-block_stmt : LBRACE stmt_list RBRACE		{ $$ = &ast.BlockStmt{0, $2 ,0} }
+block_stmt : LBRACE stmt_list RBRACE		{ $$ = &ast.BlockStmt{$1.Pos, $2, $3.Pos} }
+	   | LBRACE error RBRACE		{ $$ = &ast.BlockStmt{$1.Pos, []ast.Stmt{badStmt(Doubilex)}, $3.Pos} }
 
-if_stmt : IF expr block_stmt  			{ $$ = &ast.IfStmt{0, $2, $3.(*ast.BlockStmt), nil} }
-	| IF expr block_stmt ELSE stmt		{ $$ = &ast.IfStmt{0, $2, $3.(*ast.BlockStmt), $5} }
+if_stmt : IF expr block_stmt  			{ $$ = &ast.IfStmt{$1.Pos, $2, $3.(*ast.BlockStmt), nil} }
+	| IF expr block_stmt ELSE stmt		{ $$ = &ast.IfStmt{$1.Pos, $2, $3.(*ast.BlockStmt), $5} }
 
-case_clause : CASE expr_list COLON stmt_list	{ $$ = &ast.CaseClause{0, $2, 0, $4} }
-            | DEFAULT COLON stmt_list           { $$ = &ast.CaseClause{0, nil, 0, $3} }
+case_clause : CASE expr_list COLON stmt_list	{ $$ = &ast.CaseClause{$1.Pos, $2, $3.Pos, $4} }
+            | DEFAULT COLON stmt_list           { $$ = &ast.CaseClause{$1.Pos, nil, $2.Pos, $3} }
 
 case_clause_list : EOL	     	   		{ $$ = []ast.Stmt{} }
 		 | case_clause	   		{ $$ = []ast.Stmt{$1} }
 		 | case_clause_list case_clause { $$ = append($1, $2) }
 
-case_block : LBRACE case_clause_list RBRACE	{ $$ = &ast.BlockStmt{0, $2, 0} }
+case_block : LBRACE case_clause_list RBRACE	{ $$ = &ast.BlockStmt{$1.Pos, $2, $3.Pos} }
 
-switch_stmt : SWITCH stmt case_block		{ $$ = &ast.SwitchStmt{0, $2, $3.(*ast.BlockStmt)} }
+switch_stmt : SWITCH stmt case_block		{ $$ = &ast.SwitchStmt{$1.Pos, $2, $3.(*ast.BlockStmt)} }
 
-select_stmt : SELECT case_block			{ $$ = &ast.SelectStmt{0, $2.(*ast.BlockStmt)} }
+select_stmt : SELECT case_block			{ $$ = &ast.SelectStmt{$1.Pos, $2.(*ast.BlockStmt)} }
 
 for_stmt : FOR stmt SEMICOLON expr SEMICOLON stmt block_stmt
-	   { $$ = &ast.ForStmt{0, $2, $4, $6, $7.(*ast.BlockStmt)} }
+	   { $$ = &ast.ForStmt{$1.Pos, $2, $4, $6, $7.(*ast.BlockStmt)} }
          | FOR SEMICOLON expr SEMICOLON stmt block_stmt
-	   { $$ = &ast.ForStmt{0, nil, $3, $5, $6.(*ast.BlockStmt)} }
+	   { $$ = &ast.ForStmt{$1.Pos, nil, $3, $5, $6.(*ast.BlockStmt)} }
          | FOR expr block_stmt
-	   { $$ = &ast.ForStmt{0, nil, $2, nil, $3.(*ast.BlockStmt)} }
+	   { $$ = &ast.ForStmt{$1.Pos, nil, $2, nil, $3.(*ast.BlockStmt)} }
 
 range_stmt : FOR expr_list ASSIGN RANGE expr block_stmt 
-	     { $$ = &ast.RangeStmt{0, $2, $5, $6.(*ast.BlockStmt)} }
+	     { $$ = &ast.RangeStmt{$1.Pos, $2, token.ASSIGN, $5, $6.(*ast.BlockStmt)} }
+	   | FOR expr_list DEFINE RANGE expr block_stmt 
+	     { $$ = &ast.RangeStmt{$1.Pos, $2, token.DEFINE, $5, $6.(*ast.BlockStmt)} }
+
+try_stmt : TRY block_stmt CATCH IDENT block_stmt
+	   { $$ = &ast.TryStmt{$1.Pos, $2.(*ast.BlockStmt), $3.Pos, &ast.Ident{$4.Pos, $4.Lit, nil}, $5.(*ast.BlockStmt), nil} }
+	 | TRY block_stmt CATCH block_stmt
+	   { $$ = &ast.TryStmt{$1.Pos, $2.(*ast.BlockStmt), $3.Pos, nil, $4.(*ast.BlockStmt), nil} }
+	 | TRY block_stmt FINALLY block_stmt
+	   { $$ = &ast.TryStmt{$1.Pos, $2.(*ast.BlockStmt), token.NoPos, nil, nil, $4.(*ast.BlockStmt)} }
+	 | TRY block_stmt CATCH IDENT block_stmt FINALLY block_stmt
+	   { $$ = &ast.TryStmt{$1.Pos, $2.(*ast.BlockStmt), $3.Pos, &ast.Ident{$4.Pos, $4.Lit, nil}, $5.(*ast.BlockStmt), $7.(*ast.BlockStmt)} }
+	 | TRY block_stmt CATCH block_stmt FINALLY block_stmt
+	   { $$ = &ast.TryStmt{$1.Pos, $2.(*ast.BlockStmt), $3.Pos, nil, $4.(*ast.BlockStmt), $6.(*ast.BlockStmt)} }
 
 stmt : expr_stmt
      | send_stmt
      | incdec_stmt
      | assign_stmt
+     | decl_stmt
      | go_stmt
+     | defer_stmt
      | return_stmt
      | branch_stmt
      | block_stmt
@@ -266,15 +318,42 @@ stmt : expr_stmt
      | select_stmt
      | for_stmt
      | range_stmt
+     | try_stmt
 
 stmt_list : /* empty */			{ $$ = []ast.Stmt{} }
 	  | stmt			{ $$ = []ast.Stmt{$1} }
 	  | stmt_list EOL stmt		{ $$ = append($1, $3) }
 	  | stmt_list SEMICOLON stmt	{ $$ = append($1, $3) }
 	  | stmt_list EOL		{ $$ = $1 }
+	  | bad_stmt			{ $$ = []ast.Stmt{$1} }
+	  | stmt_list EOL bad_stmt	{ $$ = append($1, $3) }
+	  | stmt_list SEMICOLON bad_stmt	{ $$ = append($1, $3) }
+
+// a broken statement runs to the end of its line, or to the brace
+// closing its block. The blocks and dicts in it are parsed, so that
+// their braces are matched.
+bad_stmt : error %prec BADSTMT		{ $$ = badStmt(Doubilex) }
+	 | bad_stmt bad_tok		{ $$ = $1; $$.(*ast.BadStmt).To = $2.Pos + token.Pos(len($2.Lit)) }
+	 | bad_stmt block_stmt		{ $$ = $1; $$.(*ast.BadStmt).To = $2.End() }
+	 | bad_stmt dict_expr		{ $$ = $1; $$.(*ast.BadStmt).To = $2.End() }
+
+// every token but the ones ending a statement and the braces
+bad_tok : IDENT | INT | FLOAT | IMAG | STRING | CHAR
+	| SHL | SHR | AND_NOT
+	| ADD_ASSIGN | SUB_ASSIGN | MUL_ASSIGN | QUO_ASSIGN | REM_ASSIGN
+	| AND_ASSIGN | OR_ASSIGN | XOR_ASSIGN | SHL_ASSIGN | SHR_ASSIGN | AND_NOT_ASSIGN
+	| LAND | LOR | ARROW | INC | DEC | EQL
+	| NEQ | LEQ | GEQ | DEFINE | ELLIPSIS | ADD | SUB | MUL | QUO | REM | AND | OR | XOR
+	| LSS | GTR | ASSIGN | NOT
+	| LPAREN | LBRACK | COMMA | PERIOD | RPAREN | RBRACK | COLON
+	| BREAK | CATCH | CHAN | CONTINUE | CONST
+	| DEFER | ELSE | FALLTHROUGH | FINALLY | FOR
+	| FUNC | GO | GOTO | IF | IMPORT | INTERFACE | MAP | PACKAGE | RANGE | RETURN
+	| SELECT | STRUCT | SWITCH | TRY | TYPE | VAR
+	| '#' LBRACK			{ $$ = $2 }
 
 /// program
 
 prog : stmt_list EOL
-       { ProgramAst = $1 }
+       { Doubilex.(*Lexer).prog = $1 }
 
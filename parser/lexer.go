@@ -1,39 +1,54 @@
 package parser
 
 import (
-	"fmt"
-	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/jxwr/doubi/ast"
 	"github.com/jxwr/doubi/token"
 )
 
 type Lexer struct {
-	Src     string
-	Pos     int
-	Line    int
-	Col     int
-	LastTok *DoubiSymType
-
-	SavedToks []*Tok
-	lines     []string
+	Name string
+	Src  string
+	Pos  int
+	Line int
+	Col  int
+
+	Errors   ErrorList
+	lines    []string
+	prog     []ast.Stmt
+	comments []*ast.Comment
+	file     *token.File
+
+	// start of the token returned by the last call to Lex
+	tokPos  int
+	tokLine int
+	tokCol  int
+	tokLit  string
+	lastTok int
+
+	// where the last syntax error was reported
+	errPos token.Pos
+
+	// a token handed back by the parser, returned again by Lex
+	again    *Tok
+	againTok int
+
+	// with closeBlocks set, the blocks still open at the end of the
+	// file are closed there, so that the parser keeps what it has
+	closeBlocks bool
+	depth       int
+	unclosed    bool
 }
 
-func NewLexer(src string) *Lexer {
-	lex := &Lexer{Src: src, Pos: 0, Line: 1, Col: 0}
-	lex.lines = strings.Split(lex.Src, "\n")
-	return lex
+func NewLexer(file *token.File, src string) *Lexer {
+	return &Lexer{Name: file.Name(), Src: src, Pos: 0, Line: 1, Col: 0, file: file}
 }
 
 var (
-	floatRe       = regexp.MustCompile("^[0-9]+\\.[0-9]+")
-	intRe         = regexp.MustCompile("^[0-9]+")
-	stringRe      = regexp.MustCompile("^\"[^\"]*\"")
-	charRe        = regexp.MustCompile("^'.*'")
-	identRe       = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*")
-	escapeRe      = regexp.MustCompile("\\\\.")
-	lineCommentRe = regexp.MustCompile("^//.*")
-
 	SpecTokens = map[int]string{
 		EOF:     "EOF",
 		EOL:     "EOL",
@@ -44,69 +59,11 @@ var (
 		IDENT:  "IDENT",
 		INT:    "INT",
 		FLOAT:  "FLOAT",
+		IMAG:   "IMAG",
 		CHAR:   "CHAR",
 		STRING: "STRING",
 	}
 
-	OpTokens = [...]int{
-		ADD_ASSIGN, // "+=",
-		SUB_ASSIGN, // "-=",
-		MUL_ASSIGN, // "*=",
-		QUO_ASSIGN, // "/=",
-		REM_ASSIGN, // "%=",
-
-		AND_ASSIGN,     // "&=",
-		OR_ASSIGN,      // "|=",
-		XOR_ASSIGN,     // "^=",
-		SHL_ASSIGN,     // "<<=",
-		SHR_ASSIGN,     // ">>=",
-		AND_NOT_ASSIGN, // "&^=",
-
-		SHL,     // "<<",
-		SHR,     // ">>",
-		AND_NOT, // "&^",
-
-		LAND,  // "&&",
-		LOR,   // "||",
-		ARROW, // "<-",
-		INC,   // "++",
-		DEC,   // "--",
-		EQL,   // "==",
-
-		NEQ,      // "!=",
-		LEQ,      // "<=",
-		GEQ,      // ">=",
-		DEFINE,   // ":=",
-		ELLIPSIS, // "...",
-
-		ADD, // "+",
-		SUB, // "-",
-		MUL, // "*",
-		QUO, // "/",
-		REM, // "%",
-
-		AND, // "&",
-		OR,  // "|",
-		XOR, // "^",
-
-		LSS,    // "<",
-		GTR,    // ">",
-		ASSIGN, // "=",
-		NOT,    // "!",
-
-		LPAREN, // "(",
-		LBRACK, // "[",
-		LBRACE, // "{",
-		COMMA,  // ",",
-		PERIOD, // ".",
-
-		RPAREN,    // ")",
-		RBRACK,    // "]",
-		RBRACE,    // "}",
-		SEMICOLON, // ";",
-		COLON,     // ":",
-	}
-
 	OpTokenMap = map[int]string{
 		ADD_ASSIGN: "+=",
 		SUB_ASSIGN: "-=",
@@ -169,6 +126,7 @@ var (
 	KeywordTokenMap = map[int]string{
 		BREAK:    "break",
 		CASE:     "case",
+		CATCH:    "catch",
 		CHAN:     "chan",
 		CONST:    "const",
 		CONTINUE: "continue",
@@ -177,6 +135,7 @@ var (
 		DEFER:       "defer",
 		ELSE:        "else",
 		FALLTHROUGH: "fallthrough",
+		FINALLY:     "finally",
 		FOR:         "for",
 
 		FUNC:   "func",
@@ -194,150 +153,312 @@ var (
 		SELECT: "select",
 		STRUCT: "struct",
 		SWITCH: "switch",
+		TRY:    "try",
 		TYPE:   "type",
 		VAR:    "var",
 	}
 )
 
-func (l *Lexer) MkTok(lit string) Tok {
-	t := Tok{lit, l.Line, l.Col, token.Pos(l.Pos)}
-	l.SavedToks = append(l.SavedToks, &t)
-	if len(l.SavedToks) > 16 {
-		l.SavedToks = l.SavedToks[len(l.SavedToks)-16:]
+var (
+	keywords = map[string]int{}
+	ops      = map[string]int{}
+
+	// the length of the longest operator starting with a byte
+	opLen [utf8.RuneSelf]int
+)
+
+func init() {
+	for tok, kw := range KeywordTokenMap {
+		keywords[kw] = tok
+	}
+	for tok, op := range OpTokenMap {
+		ops[op] = tok
+		if len(op) > opLen[op[0]] {
+			opLen[op[0]] = len(op)
+		}
 	}
-	return t
 }
 
-func (l *Lexer) Lex(lval *DoubiSymType) int {
-	if l.Pos >= len(l.Src) {
-		return 0
+// TokenName is the name of a token returned by Lex, as used in
+// syntax errors.
+func TokenName(tok int) string {
+	if name, ok := SpecTokens[tok]; ok {
+		return name
+	}
+	if name, ok := AtomTokenMap[tok]; ok {
+		return name
+	}
+	if op, ok := OpTokenMap[tok]; ok {
+		return op
+	}
+	if kw, ok := KeywordTokenMap[tok]; ok {
+		return kw
 	}
+	return strconv.QuoteRune(rune(tok))
+}
 
-	src := l.Src[l.Pos:]
-	cur := strings.TrimLeft(src, " \t\r")
-	l.Pos += len(src) - len(cur)
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
 
-	l.LastTok = lval
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
 
-	if cur[0] == '\n' {
-		lval.tok = l.MkTok("\n")
-		l.Pos++
-		l.Line++
-		l.Col = 0
-		return EOL
+func isHex(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// number returns the length and the token of the number s starts
+// with, written as in Go. Digits that don't belong to the base, as in
+// 0b12, are taken in and rejected when the literal is checked.
+func number(s string) (int, int) {
+	n, tok := 0, INT
+	digits, exp := isDigit, byte('e')
+	if len(s) > 1 && s[0] == '0' {
+		switch s[1] | 0x20 {
+		case 'x':
+			digits, exp = isHex, 'p'
+			n = 2
+		case 'o', 'b':
+			n = 2
+		}
+	}
+	skip := func() {
+		for n < len(s) && (digits(s[n]) || s[n] == '_') {
+			n++
+		}
 	}
 
-	m := lineCommentRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return EOL
+	skip()
+	// a float needs digits after the dot, 11.times is a call
+	if n+1 < len(s) && s[n] == '.' && digits(s[n+1]) {
+		tok = FLOAT
+		n++
+		skip()
+	}
+	if n < len(s) && s[n]|0x20 == exp {
+		m := n + 1
+		if m < len(s) && (s[m] == '+' || s[m] == '-') {
+			m++
+		}
+		if m < len(s) && isDigit(s[m]) {
+			tok = FLOAT
+			n = m
+			digits = isDigit
+			skip()
+		}
 	}
+	if n < len(s) && s[n] == 'i' && !(n+1 < len(s) && (isLetter(s[n+1]) || isDigit(s[n+1]) || s[n+1] >= utf8.RuneSelf)) {
+		tok = IMAG
+		n++
+	}
+	return n, tok
+}
 
-	m = floatRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return FLOAT
+// emit makes the next n bytes, whose text is lit, the token in lval
+// and moves past them.
+func (l *Lexer) emit(lval *DoubiSymType, tok int, n int, lit string) int {
+	lval.tok = Tok{lit, l.Line, l.Col, l.file.Pos(l.Pos)}
+	l.tokLit = lit
+	l.lastTok = tok
+	switch tok {
+	case LBRACE:
+		l.depth++
+	case RBRACE:
+		if l.depth > 0 {
+			l.depth--
+		}
 	}
+	l.Pos += n
+	l.Col += n
+	return tok
+}
 
-	m = intRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return INT
+// end returns the tokens closing the blocks still open at the end of
+// the file, each one after an EOL, and reports the first of them.
+func (l *Lexer) end(lval *DoubiSymType) int {
+	if !l.closeBlocks || l.depth == 0 && !l.unclosed {
+		return 0
+	}
+	if !l.unclosed {
+		l.Error("syntax error: unexpected $end, expecting RBRACE")
+		l.unclosed = true
+	}
+	if l.lastTok != EOL {
+		return l.emit(lval, EOL, 0, "\n")
+	}
+	if l.depth == 0 {
+		return 0
 	}
+	return l.emit(lval, RBRACE, 0, "}")
+}
 
-	for _, tok := range OpTokens {
-		op := OpTokenMap[tok]
+// unread makes the next call to Lex return tok again.
+func (l *Lexer) unread(tok Tok, kind int) {
+	l.again, l.againTok = &tok, kind
+}
 
-		if strings.HasPrefix(cur, op) {
-			lval.tok = l.MkTok(op)
-			l.Col += len(op)
-			l.Pos += len(op)
-			return tok
-		}
+func (l *Lexer) Lex(lval *DoubiSymType) int {
+	if tok := l.again; tok != nil {
+		l.again = nil
+		lval.tok = *tok
+		l.tokPos, l.tokLine, l.tokCol, l.tokLit = l.file.Offset(tok.Pos), tok.Line, tok.Col, tok.Lit
+		l.lastTok = l.againTok
+		return l.againTok
 	}
 
-	for tok, kw := range KeywordTokenMap {
-		if strings.HasPrefix(cur, kw) {
-			lval.tok = l.MkTok(kw)
-			l.Col += len(kw)
-			l.Pos += len(kw)
-			return tok
+	src := l.Src
+	for {
+		for l.Pos < len(src) && (src[l.Pos] == ' ' || src[l.Pos] == '\t' || src[l.Pos] == '\r') {
+			l.Pos++
+			l.Col++
+		}
+		l.tokPos, l.tokLine, l.tokCol, l.tokLit = l.Pos, l.Line, l.Col, ""
+		if l.Pos >= len(src) {
+			return l.end(lval)
+		}
+
+		// comments are kept aside for doubi fmt, the newline after one
+		// ends the statement
+		if !strings.HasPrefix(src[l.Pos:], "//") {
+			break
+		}
+		n := strings.IndexByte(src[l.Pos:], '\n')
+		if n < 0 {
+			n = len(src) - l.Pos
 		}
+		l.comments = append(l.comments, &ast.Comment{l.file.Pos(l.Pos), src[l.Pos : l.Pos+n]})
+		l.Pos += n
+		l.Col += n
 	}
 
-	m = stringRe.FindString(cur)
-	if m != "" {
-		n := escapeRe.ReplaceAllStringFunc(m, func(s string) string {
-			esc := strings.TrimPrefix(s, "\\")
-			switch esc {
-			case "n":
-				return "\n"
-			case "t":
-				return "\t"
-			case "r":
-				return "\r"
-			case "\"":
-				return "\""
-			default:
-				return esc
+	cur := src[l.Pos:]
+	c := cur[0]
+	switch {
+	case c == '\n':
+		tok := l.emit(lval, EOL, 1, "\n")
+		l.Line++
+		l.Col = 0
+		return tok
+
+	case isDigit(c) || c == '.' && len(cur) > 1 && isDigit(cur[1]):
+		n, tok := number(cur)
+		return l.emit(lval, tok, n, cur[:n])
+
+	case isLetter(c) || c >= utf8.RuneSelf:
+		n := 0
+		for n < len(cur) {
+			if c := cur[n]; c < utf8.RuneSelf {
+				if !isLetter(c) && !(n > 0 && isDigit(c)) {
+					break
+				}
+				n++
+				continue
 			}
-		})
-		lval.tok = l.MkTok(n)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return STRING
-	}
+			r, size := utf8.DecodeRuneInString(cur[n:])
+			if !unicode.IsLetter(r) && !(n > 0 && unicode.IsDigit(r)) {
+				break
+			}
+			n += size
+		}
+		if n == 0 {
+			// a character that can't start a token
+			r, size := utf8.DecodeRuneInString(cur)
+			return l.emit(lval, int(r), size, cur[:size])
+		}
+		// after a dot a keyword is a name, as in arr.map
+		if tok, ok := keywords[cur[:n]]; ok && l.lastTok != PERIOD {
+			return l.emit(lval, tok, n, cur[:n])
+		}
+		return l.emit(lval, IDENT, n, cur[:n])
 
-	m = charRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return CHAR
+	case c == '"' || c == '\'':
+		tok, what := STRING, "string"
+		if c == '\'' {
+			tok, what = CHAR, "rune"
+		}
+		n := quoted(cur)
+		if n < 0 {
+			// the rest of the line is taken as the literal
+			l.Error(what + " literal not terminated")
+			if n = strings.IndexByte(cur, '\n'); n < 0 {
+				n = len(cur)
+			}
+		}
+		return l.emit(lval, tok, n, cur[:n])
+
+	case c == '`':
+		n := strings.IndexByte(cur[1:], '`') + 2
+		if n < 2 {
+			l.Error("raw string literal not terminated")
+			if n = strings.IndexByte(cur, '\n'); n < 0 {
+				n = len(cur)
+			}
+		}
+		m := cur[:n]
+		tok := l.emit(lval, STRING, n, m)
+		if nl := strings.Count(m, "\n"); nl > 0 {
+			l.Line += nl
+			l.Col = len(m) - strings.LastIndexByte(m, '\n') - 1
+		}
+		return tok
 	}
 
-	m = identRe.FindString(cur)
-	if m != "" {
-		lval.tok = l.MkTok(m)
-		l.Col += len(m)
-		l.Pos += len(m)
-		return IDENT
+	if c < utf8.RuneSelf {
+		for n := opLen[c]; n > 0; n-- {
+			if n > len(cur) {
+				continue
+			}
+			if tok, ok := ops[cur[:n]]; ok {
+				return l.emit(lval, tok, n, cur[:n])
+			}
+		}
 	}
 
 	// otherwise
-	l.Col++
-	l.Pos++
-	if len(cur) > 0 {
-		return int(cur[0])
-	}
+	return l.emit(lval, int(c), 1, cur[:1])
+}
 
-	return 0
+// quoted returns the length of the string or rune literal s starts
+// with, up to its closing quote, or -1 if it isn't closed on its
+// line. Its escapes are checked with its value.
+func quoted(s string) int {
+	for n := 1; n < len(s); n++ {
+		switch s[n] {
+		case s[0]:
+			return n + 1
+		case '\\':
+			if n+1 < len(s) && s[n+1] != '\n' {
+				n++
+			}
+		case '\n':
+			return -1
+		}
+	}
+	return -1
 }
 
 func (l *Lexer) Error(s string) {
-	fmt.Printf("Syntax Error: Line:%d Col:%d \nToks:%q:\n", l.Line, l.Col, l.SavedToks)
+	err := &SyntaxError{File: l.Name, Line: l.tokLine, Col: l.tokCol + 1, Tok: l.tokLit}
+	err.Msg, err.Expected = splitMessage(s)
 
-	line := l.Line - 5
-	if line < 0 {
-		line = 0
+	if l.lines == nil {
+		l.lines = strings.Split(l.Src, "\n")
 	}
-
-	for line < l.Line+5 && line < len(l.lines) {
-		if line == l.Line-1 {
-			fmt.Printf("*%3d) %s\n", line+1, l.lines[line])
-			for i := 0; i < l.Col+6+len(l.LastTok.tok.Lit); i++ {
-				fmt.Print(" ")
-			}
-			fmt.Println("^")
-		} else {
-			fmt.Printf(" %3d) %s\n", line+1, l.lines[line])
-		}
-		line++
+	first := err.Line - 5
+	if first < 1 {
+		first = 1
+	}
+	last := err.Line + 5
+	if last > len(l.lines) {
+		last = len(l.lines)
 	}
+	if first <= last {
+		err.ExcerptLine = first
+		err.Excerpt = l.lines[first-1 : last]
+	}
+
+	l.errPos = l.file.Pos(l.tokPos)
+	l.Errors = append(l.Errors, err)
 }
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"github.com/jxwr/doubi/ast"
+	"github.com/jxwr/doubi/token"
+)
+
+func init() {
+	// we want the expected tokens in the messages handed to Lexer.Error
+	DoubiErrorVerbose = true
+}
+
+// ParseFile parses a single script and registers it with fset, so
+// the positions in the returned AST can be resolved through fset.
+// All parse state lives in the lexer created for this call, so
+// concurrent calls are safe. On failure the returned error is an
+// ErrorList holding every syntax error that was reported.
+func ParseFile(fset *token.FileSet, name, src string) (*ast.File, error) {
+	tf := fset.AddFile(name, len(src))
+	tf.SetLinesForContent([]byte(src))
+
+	lex := NewLexer(tf, src)
+	lex.closeBlocks = true
+	if DoubiNewParser().Parse(lex) != 0 && lex.errPos != tf.Pos(len(src)) {
+		// the parser gives up at the end of the file, and says nothing
+		// when it is still recovering from an earlier error
+		lex.Error("syntax error: unexpected $end")
+	}
+
+	file := &ast.File{name, lex.prog, lex.comments}
+	if len(lex.Errors) > 0 {
+		return file, lex.Errors
+	}
+	return file, nil
+}
+
+// Token is a token of a script as the lexer returns it to the parser.
+type Token struct {
+	Tok int
+	Lit string
+	Pos token.Pos
+}
+
+// ScanFile splits a script into tokens without parsing it, calling
+// f with each of them, and registers it with fset. Comments are left
+// out.
+func ScanFile(fset *token.FileSet, name, src string, f func(Token)) {
+	tf := fset.AddFile(name, len(src))
+	tf.SetLinesForContent([]byte(src))
+
+	lex := NewLexer(tf, src)
+	var lval DoubiSymType
+	for {
+		tok := lex.Lex(&lval)
+		if tok == 0 {
+			return
+		}
+		f(Token{tok, lval.tok.Lit, lval.tok.Pos})
+	}
+}
@@ -0,0 +1,230 @@
+package rt
+
+import (
+	"fmt"
+
+	"github.com/jxwr/doubi/token"
+)
+
+// error kinds
+const (
+	TypeError         = "TypeError"
+	NameError         = "NameError"
+	IndexError        = "IndexError"
+	ArgumentError     = "ArgumentError"
+	ValueError        = "ValueError"
+	ZeroDivisionError = "ZeroDivisionError"
+	RecursionError    = "RecursionError"
+	InternalError     = "InternalError"
+	UserError         = "Error"
+)
+
+// MaxCallDepth is how deep calls can nest before a RecursionError,
+// well before the Go stack of either engine runs out.
+const MaxCallDepth = 1000
+
+// StackFrame is one entry of a doubi level call stack: the function
+// and the position execution had reached inside it.
+type StackFrame struct {
+	Func string         `json:"func"`
+	Pos  token.Position `json:"pos"`
+}
+
+func (self StackFrame) String() string {
+	return fmt.Sprintf("at %s (%s)", self.Func, self.Pos)
+}
+
+// RuntimeError is a failure while running a script. It is raised
+// with Raise and travels up as a Go panic until the evaluator
+// recovers it, which fills in Pos and Stack on the way.
+type RuntimeError struct {
+	Kind  string         `json:"kind"`
+	Msg   string         `json:"message"`
+	Pos   token.Position `json:"pos"`
+	Stack []StackFrame   `json:"stack"`
+
+	// the value given to throw, if any
+	Value Object `json:"-"`
+}
+
+func (self *RuntimeError) Error() string {
+	s := self.Kind + ": " + self.Msg
+	if self.Pos.IsValid() {
+		s = self.Pos.String() + ": " + s
+	}
+	// runaway recursion gives the same frame over and over
+	for i := 0; i < len(self.Stack); {
+		j := i + 1
+		for j < len(self.Stack) && self.Stack[j] == self.Stack[i] {
+			j++
+		}
+		s += "\n\t" + self.Stack[i].String()
+		if j > i+1 {
+			s += fmt.Sprintf("\n\t... repeated %d more time(s)", j-i-1)
+		}
+		i = j
+	}
+	return s
+}
+
+func NewRuntimeError(kind, format string, args ...interface{}) *RuntimeError {
+	return &RuntimeError{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Raise aborts the running script with a RuntimeError.
+func Raise(kind, format string, args ...interface{}) {
+	panic(NewRuntimeError(kind, format, args...))
+}
+
+// throw implements the throw builtin. Throwing a caught error raises
+// it again with its original stack, throw(kind, message) picks the
+// kind, and any other value becomes the message of an Error.
+func throw(args ...Object) {
+	switch len(args) {
+	case 1:
+		if e, ok := args[0].(*ErrorObject); ok {
+			panic(e.Err)
+		}
+		err := NewRuntimeError(UserError, "%s", args[0].String())
+		err.Value = args[0]
+		panic(err)
+	case 2:
+		err := NewRuntimeError(args[0].String(), "%s", args[1].String())
+		err.Value = args[1]
+		panic(err)
+	default:
+		Raise(ArgumentError, "throw expects 1 or 2 arguments, got %d", len(args))
+	}
+}
+
+var opNames = map[string]string{
+	"__add__": "+", "__sub__": "-", "__mul__": "*", "__quo__": "/", "__rem__": "%",
+	"__and__": "&", "__or__": "|", "__xor__": "^", "__shl__": "<<", "__shr__": ">>",
+	"__and_not__": "&^", "__land__": "&&", "__lor__": "||", "__not__": "!",
+	"__eql__": "==", "__lss__": "<", "__gtr__": ">", "__leq__": "<=", "__geq__": ">=", "__neq__": "!=",
+	"__inc__": "++", "__dec__": "--",
+	"__get_index__": "[]", "__set_index__": "[]=", "__slice__": "[:]", "__call__": "()",
+}
+
+func opName(method string) string {
+	if name, ok := opNames[method]; ok {
+		return name
+	}
+	if len(method) > 4 && method[:2] == "__" && method[len(method)-2:] == "__" {
+		return method[2 : len(method)-2]
+	}
+	return method
+}
+
+// noMethod reports a method or operator the receiver does not have.
+func noMethod(self Object, method string, args ...Object) {
+	if len(args) > 0 && args[0] != nil {
+		Raise(TypeError, "unsupported operation: %s %s %s", self.Name(), opName(method), args[0].Name())
+	}
+	Raise(TypeError, "%s has no method '%s'", self.Name(), opName(method))
+}
+
+// NoMethod reports a method or operator the receiver does not have.
+func NoMethod(self Object, method string, args ...Object) {
+	noMethod(self, method, args...)
+}
+
+// checkArgs makes sure a builtin method got exactly n arguments.
+func checkArgs(method string, n int, args []Object) {
+	if len(args) != n {
+		Raise(ArgumentError, "%s expects %d argument(s), got %d", method, n, len(args))
+	}
+}
+
+func toInt(method string, arg Object) int {
+	if i, ok := arg.(*IntegerObject); ok {
+		return i.Val
+	}
+	if _, ok := arg.(*BigIntObject); ok {
+		Raise(ValueError, "%s expects a smaller integer, got %s", opName(method), arg)
+	}
+	Raise(TypeError, "%s expects an integer, got %s", opName(method), typeName(arg))
+	return 0
+}
+
+func toString(method string, arg Object) string {
+	if s, ok := arg.(*StringObject); ok {
+		return s.Val
+	}
+	Raise(TypeError, "%s expects a string, got %s", opName(method), typeName(arg))
+	return ""
+}
+
+func toBool(method string, arg Object) bool {
+	if b, ok := arg.(*BoolObject); ok {
+		return b.Val
+	}
+	Raise(TypeError, "%s expects a bool, got %s", opName(method), typeName(arg))
+	return false
+}
+
+func toFloat(method string, arg Object) float64 {
+	switch v := arg.(type) {
+	case *IntegerObject:
+		return float64(v.Val)
+	case *BigIntObject:
+		return v.Float()
+	case *FloatObject:
+		return v.Val
+	}
+	Raise(TypeError, "%s expects a number, got %s", opName(method), typeName(arg))
+	return 0
+}
+
+func typeName(obj Object) string {
+	if obj == nil {
+		return "nothing"
+	}
+	return obj.Name()
+}
+
+/// error
+
+// ErrorObject is the script side view of a RuntimeError.
+type ErrorObject struct {
+	Property
+
+	Err *RuntimeError
+}
+
+func NewErrorObject(err *RuntimeError) Object {
+	obj := &ErrorObject{Property(map[string]Object{}), err}
+	obj.SetProp("message", NewStringObject(err.Msg))
+	obj.SetProp("kind", NewStringObject(err.Kind))
+	stack := []Object{}
+	for _, frame := range err.Stack {
+		stack = append(stack, NewStringObject(frame.String()))
+	}
+	obj.SetProp("stack", NewArrayObject(stack))
+	if err.Value != nil {
+		obj.SetProp("value", err.Value)
+	}
+	return obj
+}
+
+func (self *ErrorObject) Name() string {
+	return "error"
+}
+
+func (self *ErrorObject) HashCode() string {
+	return fmt.Sprintf("%p", self)
+}
+
+func (self *ErrorObject) String() string {
+	return self.Err.Kind + ": " + self.Err.Msg
+}
+
+func (self *ErrorObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	var is bool
+	if is, results = self.AccessPropMethod(method, args...); is {
+		return
+	}
+
+	noMethod(self, method, args...)
+	return
+}
@@ -1,10 +1,19 @@
 package rt
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/jxwr/doubi/ast"
-	"github.com/jxwr/doubi/env"
+	"github.com/jxwr/doubi/token"
 )
 
 type Object interface {
@@ -16,12 +25,20 @@ type Object interface {
 
 type Property map[string]Object
 
+// SetProp sets a property, making the map of an object made without
+// one, as numbers are.
 func (self *Property) SetProp(key string, val Object) {
+	if *self == nil {
+		*self = Property{}
+	}
 	(*self)[key] = val
 }
 
 func (self *Property) GetProp(key string) Object {
-	return (*self)[key]
+	if val, ok := (*self)[key]; ok {
+		return val
+	}
+	return Nil
 }
 
 func (self *Property) AccessPropMethod(method string, args ...Object) (isPropMethod bool, results []Object) {
@@ -38,16 +55,54 @@ func (self *Property) AccessPropMethod(method string, args ...Object) (isPropMet
 	return
 }
 
+// getMethod answers __get_property__ for one of methods that no
+// property of self hides, with a function calling it on self.
+func getMethod(self Object, props Property, methods map[string]bool, method string, args []Object) (Object, bool) {
+	if method != "__get_property__" {
+		return nil, false
+	}
+	name := args[0].(*StringObject).Val
+	if _, own := props[name]; own || !methods[name] {
+		return nil, false
+	}
+	return NewBuiltinFuncObject(name, self), true
+}
+
+// inplaceOps are the operators behind the compound assignments.
+// Values answer x op= y with x op y, a new value, and leave x as it
+// is.
+var inplaceOps = map[string]string{
+	"__+=__": "__add__", "__-=__": "__sub__", "__*=__": "__mul__", "__/=__": "__quo__",
+	"__%=__": "__rem__", "__&=__": "__and__", "__|=__": "__or__", "__^=__": "__xor__",
+	"__<<=__": "__shl__", "__>>=__": "__shr__", "__&^=__": "__and_not__",
+}
+
+// Inplace applies method, which implements x op= y or x++, to obj
+// and returns the new value of x: what the method returns, or obj
+// itself when it was changed in place, as arrays are.
+func Inplace(ctx *Runtime, obj Object, method string, args ...Object) Object {
+	if results := obj.Dispatch(ctx, method, args...); len(results) > 0 {
+		return results[0]
+	}
+	return obj
+}
+
 /// string
 
 type StringObject struct {
 	Property
 
 	Val string
+
+	// made by the first index or slice: whether Val is ASCII, and if
+	// not its runes, so that indexing costs no more than once a walk
+	split bool
+	ascii bool
+	runes []rune
 }
 
 func NewStringObject(val string) Object {
-	obj := &StringObject{Property(map[string]Object{}), val}
+	obj := &StringObject{Property(map[string]Object{}), val, false, false, nil}
 	return obj
 }
 
@@ -63,18 +118,257 @@ func (self *StringObject) String() string {
 	return self.Val
 }
 
+// stringMethods are the methods of strings. Strings are made all the
+// time, so like those of numbers their methods are not set as
+// properties up front but looked up when asked for.
+var stringMethods = map[string]bool{
+	"length": true, "upper": true, "lower": true, "trim": true,
+	"split": true, "join": true, "replace": true, "contains": true,
+	"starts_with": true, "ends_with": true, "index_of": true,
+	"repeat": true, "chars": true, "bytes": true,
+}
+
 func (self *StringObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	if fn, ok := getMethod(self, self.Property, stringMethods, method, args); ok {
+		return append(results, fn)
+	}
 	var is bool
 	if is, results = self.AccessPropMethod(method, args...); is {
 		return
 	}
+	if op, ok := inplaceOps[method]; ok {
+		method = op
+	}
 
 	switch method {
 	case "__add__":
+		checkArgs(method, 1, args)
 		obj := NewStringObject(self.Val + args[0].String())
 		results = append(results, obj)
-	case "__+=__":
-		self.Val += args[0].String()
+	case "__eql__", "__neq__", "__lss__", "__gtr__", "__leq__", "__geq__":
+		checkArgs(method, 1, args)
+		if other, ok := args[0].(*StringObject); ok {
+			results = append(results, compare(method, strings.Compare(self.Val, other.Val), true))
+		} else if method == "__eql__" || method == "__neq__" {
+			results = append(results, compare(method, 0, false))
+		} else {
+			noMethod(self, method, args...)
+		}
+	case "__get_index__":
+		checkArgs(method, 1, args)
+		idx := toInt(method, args[0])
+		if n := self.length(); idx < 0 || idx >= n {
+			Raise(IndexError, "index %d out of range with length %d", idx, n)
+		}
+		if self.ascii {
+			results = append(results, NewRuneObject(rune(self.Val[idx])))
+		} else {
+			results = append(results, NewRuneObject(self.runes[idx]))
+		}
+	case "__slice__":
+		checkArgs(method, 2, args)
+		n := self.length()
+		low := 0
+		high := n
+		if args[0] != nil {
+			low = toInt(method, args[0])
+		}
+		if args[1] != nil {
+			high = toInt(method, args[1])
+		}
+		if low < 0 || high > n || low > high {
+			Raise(IndexError, "slice bounds [%d:%d] out of range with length %d", low, high, n)
+		}
+		if self.ascii {
+			results = append(results, NewStringObject(self.Val[low:high]))
+		} else {
+			results = append(results, NewStringObject(string(self.runes[low:high])))
+		}
+	default:
+		results = self.classMethods(method, args...)
+	}
+	return
+}
+
+// length returns the number of runes of the string, splitting it
+// for indexing first.
+func (self *StringObject) length() int {
+	if !self.split {
+		self.split = true
+		self.ascii = true
+		for i := 0; i < len(self.Val); i++ {
+			if self.Val[i] >= utf8.RuneSelf {
+				self.ascii = false
+				self.runes = []rune(self.Val)
+				break
+			}
+		}
+	}
+	if self.ascii {
+		return len(self.Val)
+	}
+	return len(self.runes)
+}
+
+// classMethods implements stringMethods. Lengths and positions count
+// runes, as indexes do.
+func (self *StringObject) classMethods(method string, args ...Object) (results []Object) {
+	switch method {
+	case "length":
+		checkArgs(method, 0, args)
+		results = append(results, NewIntegerObject(self.length()))
+	case "upper":
+		checkArgs(method, 0, args)
+		results = append(results, NewStringObject(strings.ToUpper(self.Val)))
+	case "lower":
+		checkArgs(method, 0, args)
+		results = append(results, NewStringObject(strings.ToLower(self.Val)))
+	case "trim":
+		checkArgs(method, 0, args)
+		results = append(results, NewStringObject(strings.TrimSpace(self.Val)))
+	case "split":
+		checkArgs(method, 1, args)
+		vals := []Object{}
+		for _, s := range strings.Split(self.Val, toString(method, args[0])) {
+			vals = append(vals, NewStringObject(s))
+		}
+		results = append(results, NewArrayObject(vals))
+	case "join":
+		checkArgs(method, 1, args)
+		arr, ok := args[0].(*ArrayObject)
+		if !ok {
+			Raise(TypeError, "join expects an array, got %s", typeName(args[0]))
+		}
+		strs := make([]string, len(arr.Vals))
+		for i, val := range arr.Vals {
+			strs[i] = val.String()
+		}
+		results = append(results, NewStringObject(strings.Join(strs, self.Val)))
+	case "replace":
+		checkArgs(method, 2, args)
+		old, new := toString(method, args[0]), toString(method, args[1])
+		results = append(results, NewStringObject(strings.Replace(self.Val, old, new, -1)))
+	case "contains":
+		checkArgs(method, 1, args)
+		results = append(results, NewBoolObject(strings.Contains(self.Val, toString(method, args[0]))))
+	case "starts_with":
+		checkArgs(method, 1, args)
+		results = append(results, NewBoolObject(strings.HasPrefix(self.Val, toString(method, args[0]))))
+	case "ends_with":
+		checkArgs(method, 1, args)
+		results = append(results, NewBoolObject(strings.HasSuffix(self.Val, toString(method, args[0]))))
+	case "index_of":
+		checkArgs(method, 1, args)
+		idx := strings.Index(self.Val, toString(method, args[0]))
+		if idx > 0 {
+			idx = utf8.RuneCountInString(self.Val[:idx])
+		}
+		results = append(results, NewIntegerObject(idx))
+	case "repeat":
+		checkArgs(method, 1, args)
+		n := toInt(method, args[0])
+		if n < 0 {
+			Raise(ValueError, "repeat expects a count of at least 0, got %d", n)
+		}
+		results = append(results, NewStringObject(strings.Repeat(self.Val, n)))
+	case "chars":
+		checkArgs(method, 0, args)
+		vals := []Object{}
+		for _, r := range self.Val {
+			vals = append(vals, NewRuneObject(r))
+		}
+		results = append(results, NewArrayObject(vals))
+	case "bytes":
+		checkArgs(method, 0, args)
+		vals := make([]Object, len(self.Val))
+		for i := 0; i < len(self.Val); i++ {
+			vals[i] = NewIntegerObject(int(self.Val[i]))
+		}
+		results = append(results, NewArrayObject(vals))
+	default:
+		noMethod(self, method, args...)
+	}
+	return
+}
+
+/// rune
+
+type RuneObject struct {
+	Property
+
+	Val rune
+}
+
+func NewRuneObject(val rune) Object {
+	obj := &RuneObject{Property(map[string]Object{}), val}
+	return obj
+}
+
+func (self *RuneObject) Name() string {
+	return "rune"
+}
+
+func (self *RuneObject) HashCode() string {
+	return self.String()
+}
+
+func (self *RuneObject) String() string {
+	return string(self.Val)
+}
+
+func (self *RuneObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	var is bool
+	if is, results = self.AccessPropMethod(method, args...); is {
+		return
+	}
+
+	checkArgs(method, 1, args)
+	switch arg := args[0].(type) {
+	case *IntegerObject:
+		// 'a' + 1 is 'b'
+		switch method {
+		case "__add__":
+			results = append(results, NewRuneObject(self.Val+rune(arg.Val)))
+		case "__sub__":
+			results = append(results, NewRuneObject(self.Val-rune(arg.Val)))
+		case "__eql__":
+			results = append(results, NewBoolObject(false))
+		case "__neq__":
+			results = append(results, NewBoolObject(true))
+		default:
+			noMethod(self, method, args...)
+		}
+	case *RuneObject:
+		var cmp bool
+		switch method {
+		case "__sub__":
+			results = append(results, NewIntegerObject(int(self.Val-arg.Val)))
+			return
+		case "__eql__":
+			cmp = self.Val == arg.Val
+		case "__neq__":
+			cmp = self.Val != arg.Val
+		case "__lss__":
+			cmp = self.Val < arg.Val
+		case "__gtr__":
+			cmp = self.Val > arg.Val
+		case "__leq__":
+			cmp = self.Val <= arg.Val
+		case "__geq__":
+			cmp = self.Val >= arg.Val
+		default:
+			noMethod(self, method, args...)
+		}
+		results = append(results, NewBoolObject(cmp))
+	default:
+		switch method {
+		case "__eql__":
+			results = append(results, NewBoolObject(false))
+		case "__neq__":
+			results = append(results, NewBoolObject(true))
+		default:
+			noMethod(self, method, args...)
+		}
 	}
 	return
 }
@@ -110,20 +404,82 @@ func (self *BoolObject) Dispatch(ctx *Runtime, method string, args ...Object) (r
 		return
 	}
 
-	val := args[0].(*BoolObject).Val
+	if method == "__not__" {
+		results = append(results, NewBoolObject(!self.Val))
+		return
+	}
+
+	checkArgs(method, 1, args)
+	arg, ok := args[0].(*BoolObject)
+	if !ok {
+		switch method {
+		case "__eql__":
+			results = append(results, NewBoolObject(false))
+		case "__neq__":
+			results = append(results, NewBoolObject(true))
+		default:
+			noMethod(self, method, args...)
+		}
+		return
+	}
+
+	val := arg.Val
 	switch method {
 	case "__land__":
 		val = self.Val && val
 	case "__lor__":
 		val = self.Val || val
-	case "__not__":
-		val = !self.Val
+	case "__eql__":
+		val = self.Val == val
+	case "__neq__":
+		val = self.Val != val
+	default:
+		noMethod(self, method, args...)
 	}
 
 	results = append(results, NewBoolObject(val))
 	return
 }
 
+/// nil
+
+type NilObject struct{}
+
+// Nil is the only nil value.
+var Nil = &NilObject{}
+
+func NewNilObject() Object {
+	return Nil
+}
+
+func (self *NilObject) Name() string {
+	return "nil"
+}
+
+func (self *NilObject) HashCode() string {
+	return "nil"
+}
+
+func (self *NilObject) String() string {
+	return "nil"
+}
+
+func (self *NilObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	switch method {
+	case "__eql__":
+		checkArgs(method, 1, args)
+		results = append(results, NewBoolObject(args[0] == Nil))
+	case "__neq__":
+		checkArgs(method, 1, args)
+		results = append(results, NewBoolObject(args[0] != Nil))
+	case "__not__":
+		results = append(results, NewBoolObject(true))
+	default:
+		noMethod(self, method, args...)
+	}
+	return
+}
+
 /// integer
 
 type IntegerObject struct {
@@ -132,13 +488,16 @@ type IntegerObject struct {
 	Val int
 }
 
+// NewIntegerObject makes an integer. Every arithmetic operation makes
+// one, so it gets no property map until a property is set.
 func NewIntegerObject(val int) Object {
-	obj := &IntegerObject{Property(map[string]Object{}), val}
-	obj.SetProp("times", NewBuiltinFuncObject("times", obj, nil))
-	obj.SetProp("abs", NewBuiltinFuncObject("abs", obj, nil))
-	return obj
+	return &IntegerObject{nil, val}
 }
 
+// integerMethods are the methods of integers, looked up as those of
+// strings are.
+var integerMethods = map[string]bool{"times": true, "abs": true}
+
 func (self *IntegerObject) Name() string {
 	return "integer"
 }
@@ -151,145 +510,418 @@ func (self *IntegerObject) String() string {
 	return fmt.Sprintf("%d", self.Val)
 }
 
+// Neg returns -self, which for the smallest int is a big integer.
+func (self *IntegerObject) Neg() Object {
+	if self.Val == math.MinInt {
+		return NewBigIntObject(new(big.Int).Neg(big.NewInt(int64(self.Val))))
+	}
+	return NewIntegerObject(-self.Val)
+}
+
 func (self *IntegerObject) classMethods(ctx *Runtime, method string, args ...Object) (results []Object) {
 	switch method {
 	case "times":
-		fnobj := args[0].(*FuncObject)
-		fnDecl := fnobj.Decl
+		checkArgs(method, 1, args)
 		for i := 0; i < self.Val; i++ {
-			fnobj.E.Put(fnDecl.Args[0].Name, NewIntegerObject(i))
-			fnDecl.Body.Accept(ctx.Visitor)
+			ctx.Call(args[0], NewIntegerObject(i))
 		}
 	case "abs":
-		val := self.Val
-		if val < 0 {
-			val = 0 - val
+		checkArgs(method, 0, args)
+		if self.Val < 0 {
+			results = append(results, self.Neg())
+		} else {
+			results = append(results, NewIntegerObject(self.Val))
 		}
-		results = append(results, NewIntegerObject(val))
+	default:
+		noMethod(self, method, args...)
 	}
 	return
 }
 
-// shits
 func (self *IntegerObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	if fn, ok := getMethod(self, self.Property, integerMethods, method, args); ok {
+		return append(results, fn)
+	}
 	var is bool
 	if is, results = self.AccessPropMethod(method, args...); is {
 		return
 	}
+	if op, ok := inplaceOps[method]; ok {
+		method = op
+	}
 
-	isFloat := false
-	var val float64
-
-	if len(args) == 0 {
-		if method == "__inc__" {
-			self.Val++
-		} else if method == "__dec__" {
-			self.Val--
-		} else {
-			results = self.classMethods(ctx, method, args...)
-			return
-		}
+	switch method {
+	case "__inc__":
+		results = append(results, intOp("__add__", self.Val, 1))
+		return
+	case "__dec__":
+		results = append(results, intOp("__sub__", self.Val, 1))
+		return
+	case "times", "abs":
+		results = self.classMethods(ctx, method, args...)
 		return
 	}
 
+	checkArgs(method, 1, args)
+	var res Object
 	switch arg := args[0].(type) {
 	case *IntegerObject:
-		val = float64(arg.Val)
+		res = intOp(method, self.Val, arg.Val)
+	case *BigIntObject:
+		res = bigOp(method, big.NewInt(int64(self.Val)), arg.Val)
 	case *FloatObject:
-		isFloat = true
-		val = arg.Val
+		c, ok := cmpIntFloat(self.Val, arg.Val)
+		if res = compare(method, c, ok); res == nil {
+			res = floatOp(method, float64(self.Val), arg.Val)
+		}
+	case *ComplexObject:
+		return NewComplexObject(complex(float64(self.Val), 0)).Dispatch(ctx, method, args...)
+	default:
+		res = compare(method, 0, false)
 	}
+	if res == nil {
+		noMethod(self, method, args...)
+	}
+	results = append(results, res)
+	return
+}
 
+// intOp applies the operator method to two ints, or returns nil if
+// there is no such operator. A result that doesn't fit in an int is
+// worked out again with big integers.
+func intOp(method string, x, y int) Object {
+	var z int
 	switch method {
-	// xxx_assign
-	case "__+=__":
-		self.Val += int(val)
-		return
-	case "__-=__":
-		self.Val -= int(val)
-		return
-	case "__*=__":
-		self.Val *= int(val)
-		return
-	case "__/=__":
-		self.Val /= int(val)
-		return
-	case "__%=__":
-		self.Val %= int(val)
-		return
-	case "__|=__":
-		self.Val |= int(val)
-		return
-	case "__&=__":
-		self.Val &= int(val)
-		return
-	case "__^=__":
-		self.Val ^= int(val)
-		return
-	case "__<<=__":
-		self.Val <<= uint(val)
-		return
-	case "__>>=__":
-		self.Val >>= uint(val)
-		return
-	case "__&^___":
-		self.Val &^= int(val)
-		return
-	// binop
 	case "__add__":
-		val = float64(self.Val) + val
+		z = x + y
+		if z > x != (y > 0) {
+			return bigOp(method, big.NewInt(int64(x)), big.NewInt(int64(y)))
+		}
 	case "__sub__":
-		val = float64(self.Val) - val
+		z = x - y
+		if z < x != (y > 0) {
+			return bigOp(method, big.NewInt(int64(x)), big.NewInt(int64(y)))
+		}
 	case "__mul__":
-		val = float64(self.Val) * val
+		z = x * y
+		if x != 0 && (z/x != y || x == -1 && y == math.MinInt) {
+			return bigOp(method, big.NewInt(int64(x)), big.NewInt(int64(y)))
+		}
 	case "__quo__":
-		val = float64(self.Val) / val
+		if y == 0 {
+			Raise(ZeroDivisionError, "integer division by zero")
+		}
+		if x == math.MinInt && y == -1 {
+			return bigOp(method, big.NewInt(int64(x)), big.NewInt(int64(y)))
+		}
+		z = x / y
 	case "__rem__":
-		val = float64(self.Val % int(val))
+		if y == 0 {
+			Raise(ZeroDivisionError, "integer division by zero")
+		}
+		z = x % y
 	case "__and__":
-		val = float64(self.Val & int(val))
+		z = x & y
 	case "__or__":
-		val = float64(self.Val | int(val))
+		z = x | y
 	case "__xor__":
-		val = float64(self.Val ^ int(val))
+		z = x ^ y
+	case "__and_not__":
+		z = x &^ y
 	case "__shl__":
-		val = float64(uint(self.Val) << uint(val))
+		if y < 0 {
+			Raise(ValueError, "negative shift count %d", y)
+		}
+		if y >= bits.UintSize || x<<uint(y)>>uint(y) != x {
+			return bigOp(method, big.NewInt(int64(x)), big.NewInt(int64(y)))
+		}
+		z = x << uint(y)
 	case "__shr__":
-		val = float64(uint(self.Val) >> uint(val))
+		if y < 0 {
+			Raise(ValueError, "negative shift count %d", y)
+		}
+		if y >= bits.UintSize {
+			y = bits.UintSize - 1
+		}
+		z = x >> uint(y)
 	case "__eql__":
-		cmp := float64(self.Val) == val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x == y)
+	case "__neq__":
+		return NewBoolObject(x != y)
 	case "__lss__":
-		cmp := float64(self.Val) < val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x < y)
 	case "__gtr__":
-		cmp := float64(self.Val) > val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x > y)
 	case "__leq__":
-		cmp := float64(self.Val) <= val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x <= y)
 	case "__geq__":
-		cmp := float64(self.Val) >= val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x >= y)
+	default:
+		return nil
+	}
+	return NewIntegerObject(z)
+}
+
+// bigOp is intOp for big integers. Shifts and division round as
+// they do on ints.
+func bigOp(method string, x, y *big.Int) Object {
+	z := new(big.Int)
+	switch method {
+	case "__add__":
+		z.Add(x, y)
+	case "__sub__":
+		z.Sub(x, y)
+	case "__mul__":
+		z.Mul(x, y)
+	case "__quo__":
+		if y.Sign() == 0 {
+			Raise(ZeroDivisionError, "integer division by zero")
+		}
+		z.Quo(x, y)
+	case "__rem__":
+		if y.Sign() == 0 {
+			Raise(ZeroDivisionError, "integer division by zero")
+		}
+		z.Rem(x, y)
+	case "__and__":
+		z.And(x, y)
+	case "__or__":
+		z.Or(x, y)
+	case "__xor__":
+		z.Xor(x, y)
+	case "__and_not__":
+		z.AndNot(x, y)
+	case "__shl__":
+		z.Lsh(x, shiftCount(y))
+	case "__shr__":
+		z.Rsh(x, shiftCount(y))
+	case "__eql__":
+		return NewBoolObject(x.Cmp(y) == 0)
 	case "__neq__":
-		cmp := float64(self.Val) != val
-		results = append(results, NewBoolObject(cmp))
-		return
+		return NewBoolObject(x.Cmp(y) != 0)
+	case "__lss__":
+		return NewBoolObject(x.Cmp(y) < 0)
+	case "__gtr__":
+		return NewBoolObject(x.Cmp(y) > 0)
+	case "__leq__":
+		return NewBoolObject(x.Cmp(y) <= 0)
+	case "__geq__":
+		return NewBoolObject(x.Cmp(y) >= 0)
 	default:
-		results = self.classMethods(ctx, method, args...)
+		return nil
+	}
+	return NewBigIntObject(z)
+}
+
+// maxShift bounds the shifts of big integers, 1 << maxShift takes
+// 128MB.
+const maxShift = 1 << 30
+
+func shiftCount(y *big.Int) uint {
+	if y.Sign() < 0 {
+		Raise(ValueError, "negative shift count %s", y)
+	}
+	if !y.IsInt64() || y.Int64() > maxShift {
+		Raise(ValueError, "shift count %s too large", y)
+	}
+	return uint(y.Int64())
+}
+
+// compare turns c, how x compares to y as -1, 0 or +1, into the
+// result of the comparison method, or returns nil if method isn't
+// one. Values that can't be ordered, NaN or values of other types,
+// have ok false and are only unequal.
+func compare(method string, c int, ok bool) Object {
+	switch method {
+	case "__eql__":
+		return NewBoolObject(ok && c == 0)
+	case "__neq__":
+		return NewBoolObject(!ok || c != 0)
+	case "__lss__":
+		return NewBoolObject(ok && c < 0)
+	case "__gtr__":
+		return NewBoolObject(ok && c > 0)
+	case "__leq__":
+		return NewBoolObject(ok && c <= 0)
+	case "__geq__":
+		return NewBoolObject(ok && c >= 0)
+	}
+	return nil
+}
+
+// equal reports whether a == b. Objects without == are only equal to
+// themselves.
+func equal(ctx *Runtime, a, b Object) bool {
+	switch a.(type) {
+	case *NilObject, *BoolObject, *IntegerObject, *BigIntObject, *FloatObject,
+		*ComplexObject, *StringObject, *RuneObject:
+		return toBool("__eql__", a.Dispatch(ctx, "__eql__", b)[0])
+	}
+	return a == b
+}
+
+// cmpIntFloat compares x with f exactly. float64(x) would round
+// above 2^53 and make 1<<53 + 1 equal to 1<<53.
+func cmpIntFloat(x int, f float64) (int, bool) {
+	if x >= -1<<53 && x <= 1<<53 {
+		return cmpFloat(float64(x), f)
+	}
+	return cmpBigFloat(big.NewInt(int64(x)), f)
+}
+
+func cmpBigFloat(x *big.Int, f float64) (int, bool) {
+	if math.IsNaN(f) {
+		return 0, false
+	}
+	return new(big.Float).SetInt(x).Cmp(big.NewFloat(f)), true
+}
+
+func cmpFloat(x, y float64) (int, bool) {
+	switch {
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	case x == y:
+		return 0, true
+	}
+	return 0, false
+}
+
+// floatOp applies the arithmetic operator method to two floats, or
+// returns nil if floats don't have it. Division by zero gives an
+// infinity or NaN as in IEEE 754, and % takes the sign of x as it
+// does for integers.
+func floatOp(method string, x, y float64) Object {
+	switch method {
+	case "__add__":
+		return NewFloatObject(x + y)
+	case "__sub__":
+		return NewFloatObject(x - y)
+	case "__mul__":
+		return NewFloatObject(x * y)
+	case "__quo__":
+		return NewFloatObject(x / y)
+	case "__rem__":
+		return NewFloatObject(math.Mod(x, y))
+	}
+	c, ok := cmpFloat(x, y)
+	return compare(method, c, ok)
+}
+
+// FormatFloat writes f in the fewest digits that read back as f,
+// with a decimal point or an exponent so that it doesn't look like
+// an integer: 0.1, 1.0, 1e+100, inf, nan.
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-4 || abs >= 1e16) {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+/// big integer
+
+// BigIntObject is an integer that doesn't fit in an int. Integer
+// arithmetic moves to it on overflow and back once the result fits,
+// so scripts only ever see integers.
+type BigIntObject struct {
+	Property
+
+	Val *big.Int
+}
+
+// NewBigIntObject makes an integer of val, which it keeps, as an
+// IntegerObject when it fits in one.
+func NewBigIntObject(val *big.Int) Object {
+	if val.IsInt64() && val.Int64() >= math.MinInt && val.Int64() <= math.MaxInt {
+		return NewIntegerObject(int(val.Int64()))
+	}
+	return &BigIntObject{nil, val}
+}
+
+var bigIntMethods = map[string]bool{"abs": true}
+
+func (self *BigIntObject) Name() string {
+	return "integer"
+}
+
+func (self *BigIntObject) HashCode() string {
+	return self.String()
+}
+
+func (self *BigIntObject) String() string {
+	return self.Val.String()
+}
+
+// Neg returns -self.
+func (self *BigIntObject) Neg() Object {
+	return NewBigIntObject(new(big.Int).Neg(self.Val))
+}
+
+// Float is self as the nearest float.
+func (self *BigIntObject) Float() float64 {
+	f, _ := new(big.Float).SetInt(self.Val).Float64()
+	return f
+}
+
+func (self *BigIntObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	if fn, ok := getMethod(self, self.Property, bigIntMethods, method, args); ok {
+		return append(results, fn)
+	}
+	var is bool
+	if is, results = self.AccessPropMethod(method, args...); is {
 		return
 	}
+	if op, ok := inplaceOps[method]; ok {
+		method = op
+	}
 
-	if isFloat {
-		results = append(results, NewFloatObject(val))
-	} else {
-		results = append(results, NewIntegerObject(int(val)))
+	switch method {
+	case "__inc__":
+		results = append(results, NewBigIntObject(new(big.Int).Add(self.Val, big.NewInt(1))))
+		return
+	case "__dec__":
+		results = append(results, NewBigIntObject(new(big.Int).Sub(self.Val, big.NewInt(1))))
+		return
+	case "abs":
+		checkArgs(method, 0, args)
+		results = append(results, NewBigIntObject(new(big.Int).Abs(self.Val)))
+		return
+	}
+
+	checkArgs(method, 1, args)
+	var res Object
+	switch arg := args[0].(type) {
+	case *IntegerObject:
+		res = bigOp(method, self.Val, big.NewInt(int64(arg.Val)))
+	case *BigIntObject:
+		res = bigOp(method, self.Val, arg.Val)
+	case *FloatObject:
+		c, ok := cmpBigFloat(self.Val, arg.Val)
+		if res = compare(method, c, ok); res == nil {
+			res = floatOp(method, self.Float(), arg.Val)
+		}
+	case *ComplexObject:
+		return NewComplexObject(complex(self.Float(), 0)).Dispatch(ctx, method, args...)
+	default:
+		res = compare(method, 0, false)
 	}
+	if res == nil {
+		noMethod(self, method, args...)
+	}
+	results = append(results, res)
 	return
 }
 
@@ -302,8 +934,7 @@ type FloatObject struct {
 }
 
 func NewFloatObject(val float64) Object {
-	obj := &FloatObject{Property(map[string]Object{}), val}
-	return obj
+	return &FloatObject{nil, val}
 }
 
 func (self *FloatObject) HashCode() string {
@@ -315,7 +946,7 @@ func (self *FloatObject) Name() string {
 }
 
 func (self *FloatObject) String() string {
-	return fmt.Sprintf("%f", self.Val)
+	return FormatFloat(self.Val)
 }
 
 func (self *FloatObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
@@ -323,29 +954,116 @@ func (self *FloatObject) Dispatch(ctx *Runtime, method string, args ...Object) (
 	if is, results = self.AccessPropMethod(method, args...); is {
 		return
 	}
+	if op, ok := inplaceOps[method]; ok {
+		method = op
+	}
 
-	var val float64
+	checkArgs(method, 1, args)
+	var res Object
+	switch arg := args[0].(type) {
+	case *IntegerObject:
+		c, ok := cmpIntFloat(arg.Val, self.Val)
+		if res = compare(method, -c, ok); res == nil {
+			res = floatOp(method, self.Val, float64(arg.Val))
+		}
+	case *BigIntObject:
+		c, ok := cmpBigFloat(arg.Val, self.Val)
+		if res = compare(method, -c, ok); res == nil {
+			res = floatOp(method, self.Val, arg.Float())
+		}
+	case *FloatObject:
+		res = floatOp(method, self.Val, arg.Val)
+	case *ComplexObject:
+		return NewComplexObject(complex(self.Val, 0)).Dispatch(ctx, method, args...)
+	default:
+		res = compare(method, 0, false)
+	}
+	if res == nil {
+		noMethod(self, method, args...)
+	}
+	results = append(results, res)
+	return
+}
+
+/// complex
+
+type ComplexObject struct {
+	Property
+
+	Val complex128
+}
 
+func NewComplexObject(val complex128) Object {
+	return &ComplexObject{nil, val}
+}
+
+var complexMethods = map[string]bool{"real": true, "imag": true, "abs": true}
+
+func (self *ComplexObject) HashCode() string {
+	return self.String()
+}
+
+func (self *ComplexObject) Name() string {
+	return "complex"
+}
+
+func (self *ComplexObject) String() string {
+	im := FormatFloat(imag(self.Val))
+	if im[0] != '-' {
+		im = "+" + im
+	}
+	return "(" + FormatFloat(real(self.Val)) + im + "i)"
+}
+
+func (self *ComplexObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	if fn, ok := getMethod(self, self.Property, complexMethods, method, args); ok {
+		return append(results, fn)
+	}
+	var is bool
+	if is, results = self.AccessPropMethod(method, args...); is {
+		return
+	}
+	if op, ok := inplaceOps[method]; ok {
+		method = op
+	}
+
+	switch method {
+	case "real":
+		checkArgs(method, 0, args)
+		return append(results, NewFloatObject(real(self.Val)))
+	case "imag":
+		checkArgs(method, 0, args)
+		return append(results, NewFloatObject(imag(self.Val)))
+	case "abs":
+		checkArgs(method, 0, args)
+		return append(results, NewFloatObject(cmplx.Abs(self.Val)))
+	}
+
+	var val complex128
+
+	checkArgs(method, 1, args)
 	switch arg := args[0].(type) {
 	case *IntegerObject:
-		val = float64(arg.Val)
+		val = complex(float64(arg.Val), 0)
+	case *BigIntObject:
+		val = complex(arg.Float(), 0)
 	case *FloatObject:
+		val = complex(arg.Val, 0)
+	case *ComplexObject:
 		val = arg.Val
+	default:
+		switch method {
+		case "__eql__":
+			results = append(results, NewBoolObject(false))
+		case "__neq__":
+			results = append(results, NewBoolObject(true))
+		default:
+			noMethod(self, method, args...)
+		}
+		return
 	}
 
 	switch method {
-	case "__+=__":
-		self.Val += val
-		return
-	case "__-=__":
-		self.Val -= val
-		return
-	case "__*=__":
-		self.Val *= val
-		return
-	case "__/=__":
-		self.Val /= val
-		return
 	case "__add__":
 		val = self.Val + val
 	case "__sub__":
@@ -355,34 +1073,76 @@ func (self *FloatObject) Dispatch(ctx *Runtime, method string, args ...Object) (
 	case "__quo__":
 		val = self.Val / val
 	case "__eql__":
-		cmp := self.Val == val
-		results = append(results, NewBoolObject(cmp))
-		return
-	case "__lss__":
-		cmp := self.Val < val
-		results = append(results, NewBoolObject(cmp))
-		return
-	case "__gtr__":
-		cmp := self.Val > val
-		results = append(results, NewBoolObject(cmp))
-		return
-	case "__leq__":
-		cmp := self.Val <= val
-		results = append(results, NewBoolObject(cmp))
-		return
-	case "__geq__":
-		cmp := self.Val >= val
-		results = append(results, NewBoolObject(cmp))
+		results = append(results, NewBoolObject(self.Val == val))
 		return
 	case "__neq__":
-		cmp := self.Val != val
-		results = append(results, NewBoolObject(cmp))
+		results = append(results, NewBoolObject(self.Val != val))
 		return
+	default:
+		noMethod(self, method, args...)
 	}
-	results = append(results, NewFloatObject(val))
+	results = append(results, NewComplexObject(val))
 	return
 }
 
+// ParseLit makes the value of a literal of kind INT, FLOAT, IMAG,
+// STRING or CHAR, written as in Go.
+func ParseLit(kind token.Token, lit string) (Object, error) {
+	switch kind {
+	case token.INT:
+		val, ok := new(big.Int).SetString(lit, 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid int literal %s", lit)
+		}
+		return NewBigIntObject(val), nil
+	case token.FLOAT:
+		val, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return nil, numberError(lit, "float", err)
+		}
+		return NewFloatObject(val), nil
+	case token.IMAG:
+		num := strings.TrimSuffix(lit, "i")
+		val, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			// 0b and 0o are only taken by ParseInt
+			i, ierr := strconv.ParseInt(num, 0, 0)
+			if ierr != nil {
+				return nil, numberError(lit, "complex", err)
+			}
+			val = float64(i)
+		}
+		return NewComplexObject(complex(0, val)), nil
+	case token.STRING:
+		if strings.HasPrefix(lit, "`") {
+			// raw strings drop carriage returns, as in Go
+			val := strings.Replace(lit[1:len(lit)-1], "\r", "", -1)
+			return NewStringObject(val), nil
+		}
+		val, err := strconv.Unquote(lit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string literal %s", lit)
+		}
+		return NewStringObject(val), nil
+	case token.CHAR:
+		if len(lit) > 2 {
+			val, _, tail, err := strconv.UnquoteChar(lit[1:len(lit)-1], '\'')
+			if err == nil && tail == "" {
+				return NewRuneObject(val), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid rune literal %s", lit)
+	}
+	return nil, fmt.Errorf("unexpected literal %s", lit)
+}
+
+func numberError(lit, kind string, err error) error {
+	if errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%s overflows %s", lit, kind)
+	}
+	return fmt.Errorf("invalid %s literal %s", kind, lit)
+}
+
 /// array
 
 type ArrayObject struct {
@@ -393,12 +1153,19 @@ type ArrayObject struct {
 
 func NewArrayObject(vals []Object) Object {
 	obj := &ArrayObject{Property(map[string]Object{}), vals}
-	obj.SetProp("append", NewBuiltinFuncObject("append", obj, nil))
-	obj.SetProp("length", NewBuiltinFuncObject("length", obj, nil))
-
 	return obj
 }
 
+// arrayMethods are the methods of arrays, looked up as those of
+// strings are.
+var arrayMethods = map[string]bool{
+	"append": true, "length": true, "map": true, "filter": true,
+	"reduce": true, "each": true, "sort": true, "reverse": true,
+	"index_of": true, "contains": true, "insert": true, "remove_at": true,
+	"pop": true, "join": true, "zip": true, "flatten": true, "uniq": true,
+	"min": true, "max": true, "sum": true, "first": true, "last": true,
+}
+
 func (self *ArrayObject) Name() string {
 	return "array"
 }
@@ -421,6 +1188,9 @@ func (self *ArrayObject) String() string {
 }
 
 func (self *ArrayObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
+	if fn, ok := getMethod(self, self.Property, arrayMethods, method, args); ok {
+		return append(results, fn)
+	}
 	var is bool
 	if is, results = self.AccessPropMethod(method, args...); is {
 		return
@@ -428,45 +1198,259 @@ func (self *ArrayObject) Dispatch(ctx *Runtime, method string, args ...Object) (
 
 	switch method {
 	case "__add__":
-		vals := append(self.Vals[:], args[0].(*ArrayObject).Vals...)
+		checkArgs(method, 1, args)
+		other, ok := args[0].(*ArrayObject)
+		if !ok {
+			noMethod(self, method, args...)
+		}
+		vals := append([]Object{}, self.Vals...)
+		vals = append(vals, other.Vals...)
 		ret := NewArrayObject(vals)
 		results = append(results, ret)
 	case "__+=__":
-		self.Vals = append(self.Vals, args[0].(*ArrayObject).Vals...)
+		checkArgs(method, 1, args)
+		other, ok := args[0].(*ArrayObject)
+		if !ok {
+			noMethod(self, method, args...)
+		}
+		self.Vals = append(self.Vals, other.Vals...)
 	case "__get_index__":
-		idx := args[0].(*IntegerObject)
-		obj := self.Vals[idx.Val]
-		results = append(results, obj)
+		checkArgs(method, 1, args)
+		idx := self.index(toInt(method, args[0]))
+		results = append(results, self.Vals[idx])
 	case "__set_index__":
-		idx := args[0].(*IntegerObject)
-		val := args[1]
-		self.Vals[idx.Val] = val
+		checkArgs(method, 2, args)
+		idx := self.index(toInt(method, args[0]))
+		self.Vals[idx] = args[1]
 	case "__slice__":
+		checkArgs(method, 2, args)
 		low := 0
 		high := len(self.Vals)
 
 		lo := args[0]
 		if lo != nil {
-			low = lo.(*IntegerObject).Val
+			low = toInt(method, lo)
 		}
 		ho := args[1]
 		if ho != nil {
-			high = ho.(*IntegerObject).Val
+			high = toInt(method, ho)
+		}
+		if low < 0 || high > len(self.Vals) || low > high {
+			Raise(IndexError, "slice bounds [%d:%d] out of range with length %d", low, high, len(self.Vals))
 		}
 
-		vals := self.Vals[low:high]
+		vals := append([]Object{}, self.Vals[low:high]...)
 		ret := NewArrayObject(vals)
 		results = append(results, ret)
 	case "append":
+		checkArgs(method, 1, args)
 		val := args[0]
 		self.Vals = append(self.Vals, val)
 	case "length":
+		checkArgs(method, 0, args)
 		ret := NewIntegerObject(len(self.Vals))
 		results = append(results, ret)
+	default:
+		results = self.classMethods(ctx, method, args...)
 	}
 	return
 }
 
+// classMethods implements the arrayMethods other than append and
+// length. The ones that take a function call it as the script would.
+// map, filter, sort, reverse, zip, flatten and uniq return a new
+// array, insert, remove_at and pop change this one.
+func (self *ArrayObject) classMethods(ctx *Runtime, method string, args ...Object) (results []Object) {
+	switch method {
+	case "map":
+		checkArgs(method, 1, args)
+		vals := make([]Object, len(self.Vals))
+		for i, val := range self.Vals {
+			vals[i] = call(ctx, args[0], val)
+		}
+		results = append(results, NewArrayObject(vals))
+	case "filter":
+		checkArgs(method, 1, args)
+		vals := []Object{}
+		for _, val := range self.Vals {
+			if toBool(method, call(ctx, args[0], val)) {
+				vals = append(vals, val)
+			}
+		}
+		results = append(results, NewArrayObject(vals))
+	case "reduce":
+		// reduce(fn, init), or reduce(fn) starting from the first element
+		if len(args) != 1 && len(args) != 2 {
+			Raise(ArgumentError, "%s expects 1 or 2 argument(s), got %d", method, len(args))
+		}
+		vals := self.Vals
+		var acc Object
+		if len(args) == 2 {
+			acc = args[1]
+		} else if len(vals) > 0 {
+			acc, vals = vals[0], vals[1:]
+		} else {
+			Raise(ValueError, "reduce of an empty array needs a start value")
+		}
+		for _, val := range vals {
+			acc = call(ctx, args[0], acc, val)
+		}
+		results = append(results, acc)
+	case "each":
+		checkArgs(method, 1, args)
+		for _, val := range self.Vals {
+			call(ctx, args[0], val)
+		}
+	case "sort":
+		// sort(), or sort(less) where less(a, b) tells if a goes first
+		if len(args) > 1 {
+			Raise(ArgumentError, "%s expects 0 or 1 argument(s), got %d", method, len(args))
+		}
+		vals := append([]Object{}, self.Vals...)
+		sort.SliceStable(vals, func(i, j int) bool {
+			if len(args) == 1 {
+				return toBool(method, call(ctx, args[0], vals[i], vals[j]))
+			}
+			return toBool(method, vals[i].Dispatch(ctx, "__lss__", vals[j])[0])
+		})
+		results = append(results, NewArrayObject(vals))
+	case "reverse":
+		checkArgs(method, 0, args)
+		vals := make([]Object, len(self.Vals))
+		for i, val := range self.Vals {
+			vals[len(vals)-1-i] = val
+		}
+		results = append(results, NewArrayObject(vals))
+	case "index_of", "contains":
+		checkArgs(method, 1, args)
+		idx := -1
+		for i, val := range self.Vals {
+			if equal(ctx, val, args[0]) {
+				idx = i
+				break
+			}
+		}
+		if method == "contains" {
+			results = append(results, NewBoolObject(idx >= 0))
+		} else {
+			results = append(results, NewIntegerObject(idx))
+		}
+	case "insert":
+		checkArgs(method, 2, args)
+		idx := toInt(method, args[0])
+		if idx < 0 || idx > len(self.Vals) {
+			Raise(IndexError, "index %d out of range with length %d", idx, len(self.Vals))
+		}
+		self.Vals = append(self.Vals, nil)
+		copy(self.Vals[idx+1:], self.Vals[idx:])
+		self.Vals[idx] = args[1]
+	case "remove_at":
+		checkArgs(method, 1, args)
+		idx := self.index(toInt(method, args[0]))
+		val := self.Vals[idx]
+		self.Vals = append(self.Vals[:idx], self.Vals[idx+1:]...)
+		results = append(results, val)
+	case "pop":
+		checkArgs(method, 0, args)
+		if len(self.Vals) == 0 {
+			Raise(IndexError, "pop from an empty array")
+		}
+		val := self.Vals[len(self.Vals)-1]
+		self.Vals = self.Vals[:len(self.Vals)-1]
+		results = append(results, val)
+	case "join":
+		checkArgs(method, 1, args)
+		strs := make([]string, len(self.Vals))
+		for i, val := range self.Vals {
+			strs[i] = val.String()
+		}
+		results = append(results, NewStringObject(strings.Join(strs, toString(method, args[0]))))
+	case "zip":
+		checkArgs(method, 1, args)
+		other, ok := args[0].(*ArrayObject)
+		if !ok {
+			Raise(TypeError, "zip expects an array, got %s", typeName(args[0]))
+		}
+		vals := []Object{}
+		for i := 0; i < len(self.Vals) && i < len(other.Vals); i++ {
+			vals = append(vals, NewArrayObject([]Object{self.Vals[i], other.Vals[i]}))
+		}
+		results = append(results, NewArrayObject(vals))
+	case "flatten":
+		// one level, an array can hold itself
+		checkArgs(method, 0, args)
+		vals := []Object{}
+		for _, val := range self.Vals {
+			if arr, ok := val.(*ArrayObject); ok {
+				vals = append(vals, arr.Vals...)
+			} else {
+				vals = append(vals, val)
+			}
+		}
+		results = append(results, NewArrayObject(vals))
+	case "uniq":
+		checkArgs(method, 0, args)
+		vals := []Object{}
+		seen := map[string]bool{}
+		for _, val := range self.Vals {
+			// 1 and "1" have the same hash code
+			key := val.Name() + ":" + val.HashCode()
+			if !seen[key] {
+				seen[key] = true
+				vals = append(vals, val)
+			}
+		}
+		results = append(results, NewArrayObject(vals))
+	case "min", "max":
+		checkArgs(method, 0, args)
+		if len(self.Vals) == 0 {
+			Raise(ValueError, "%s of an empty array", method)
+		}
+		op := "__lss__"
+		if method == "max" {
+			op = "__gtr__"
+		}
+		best := self.Vals[0]
+		for _, val := range self.Vals[1:] {
+			if toBool(method, val.Dispatch(ctx, op, best)[0]) {
+				best = val
+			}
+		}
+		results = append(results, best)
+	case "sum":
+		checkArgs(method, 0, args)
+		if len(self.Vals) == 0 {
+			results = append(results, NewIntegerObject(0))
+			return
+		}
+		acc := self.Vals[0]
+		for _, val := range self.Vals[1:] {
+			acc = acc.Dispatch(ctx, "__add__", val)[0]
+		}
+		results = append(results, acc)
+	case "first", "last":
+		checkArgs(method, 0, args)
+		switch {
+		case len(self.Vals) == 0:
+			results = append(results, Nil)
+		case method == "first":
+			results = append(results, self.Vals[0])
+		default:
+			results = append(results, self.Vals[len(self.Vals)-1])
+		}
+	default:
+		noMethod(self, method, args...)
+	}
+	return
+}
+
+func (self *ArrayObject) index(idx int) int {
+	if idx < 0 || idx >= len(self.Vals) {
+		Raise(IndexError, "index %d out of range with length %d", idx, len(self.Vals))
+	}
+	return idx
+}
+
 /// set
 
 type SetObject struct {
@@ -507,10 +1491,7 @@ func (self *SetObject) Dispatch(ctx *Runtime, method string, args ...Object) (re
 		return
 	}
 
-	switch method {
-	case "__add__":
-		fmt.Println("__add__")
-	}
+	noMethod(self, method, args...)
 	return
 }
 
@@ -524,16 +1505,21 @@ type FuncObject struct {
 
 	IsBuiltin bool
 	Obj       Object
-	E         *env.Env
+	Upvals    []*Cell // the outer variables the function uses
+}
+
+// Cell holds a variable captured by a closure.
+type Cell struct {
+	Val Object
 }
 
-func NewFuncObject(name string, decl *ast.FuncDeclExpr, e *env.Env) Object {
-	obj := &FuncObject{Property(map[string]Object{}), name, decl, false, nil, e}
+func NewFuncObject(name string, decl *ast.FuncDeclExpr, upvals []*Cell) Object {
+	obj := &FuncObject{Property(map[string]Object{}), name, decl, false, nil, upvals}
 	return obj
 }
 
-func NewBuiltinFuncObject(name string, recv Object, e *env.Env) Object {
-	obj := &FuncObject{Property(map[string]Object{}), name, nil, true, recv, e}
+func NewBuiltinFuncObject(name string, recv Object) Object {
+	obj := &FuncObject{Property(map[string]Object{}), name, nil, true, recv, nil}
 	return obj
 }
 
@@ -558,6 +1544,55 @@ var Builtins = map[string]func(args ...Object) []Object{
 		fmt.Print(ifs...)
 		return
 	},
+	"throw": func(args ...Object) (results []Object) {
+		throw(args...)
+		return
+	},
+	"div": func(args ...Object) (results []Object) {
+		checkArgs("div", 2, args)
+		q, _ := divMod("div", args[0], args[1])
+		return append(results, q)
+	},
+	"mod": func(args ...Object) (results []Object) {
+		checkArgs("mod", 2, args)
+		_, r := divMod("mod", args[0], args[1])
+		return append(results, r)
+	},
+}
+
+// divMod divides x by y rounding the quotient down, so that the
+// remainder has the sign of y, where / and % round toward zero.
+// Integers give integers, anything else floats.
+func divMod(name string, x, y Object) (Object, Object) {
+	bx, xok := x.(*BigIntObject)
+	by, yok := y.(*BigIntObject)
+	if ix, ok := x.(*IntegerObject); ok {
+		bx, xok = &BigIntObject{Val: big.NewInt(int64(ix.Val))}, true
+	}
+	if iy, ok := y.(*IntegerObject); ok {
+		by, yok = &BigIntObject{Val: big.NewInt(int64(iy.Val))}, true
+	}
+	if xok && yok {
+		if by.Val.Sign() == 0 {
+			Raise(ZeroDivisionError, "integer division by zero")
+		}
+		q, r := new(big.Int).QuoRem(bx.Val, by.Val, new(big.Int))
+		if r.Sign() != 0 && r.Sign() != by.Val.Sign() {
+			q.Sub(q, big.NewInt(1))
+			r.Add(r, by.Val)
+		}
+		return NewBigIntObject(q), NewBigIntObject(r)
+	}
+
+	fx, fy := toFloat(name, x), toFloat(name, y)
+	if fy == 0 {
+		return NewFloatObject(math.Floor(fx / fy)), NewFloatObject(math.NaN())
+	}
+	r := math.Mod(fx, fy)
+	if r != 0 && (r < 0) != (fy < 0) {
+		r += fy
+	}
+	return NewFloatObject(math.Floor((fx - r) / fy)), NewFloatObject(r)
 }
 
 func (self *FuncObject) Dispatch(ctx *Runtime, method string, args ...Object) (results []Object) {
@@ -570,12 +1605,15 @@ func (self *FuncObject) Dispatch(ctx *Runtime, method string, args ...Object) (r
 	case "__call__":
 		if self.Decl == nil && self.Obj == nil {
 			fn, ok := Builtins[self.name]
-			if ok {
-				results = fn(args...)
+			if !ok {
+				Raise(NameError, "builtin '%s' is not defined", self.name)
 			}
+			results = fn(args...)
 		} else {
 			results = self.Obj.Dispatch(ctx, self.name, args...)
 		}
+	default:
+		noMethod(self, method, args...)
 	}
 	return
 }
@@ -626,12 +1664,16 @@ func (self *DictObject) Dispatch(ctx *Runtime, method string, args ...Object) (r
 
 	switch method {
 	case "__get_index__":
+		checkArgs(method, 1, args)
 		idx := args[0]
 		results = append(results, self.GetProp(idx.HashCode()))
 	case "__set_index__":
+		checkArgs(method, 2, args)
 		idx := args[0]
 		val := args[1]
 		self.SetProp(idx.HashCode(), val)
+	default:
+		noMethod(self, method, args...)
 	}
 	return
 }
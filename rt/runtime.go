@@ -1,9 +1,17 @@
 package rt
 
-import (
-	"github.com/jxwr/doubi/ast"
-)
-
+// Runtime is the view objects have of the engine running the script.
 type Runtime struct {
-	Visitor ast.Visitor
+	// Call calls a function value and returns its results.
+	Call func(fn Object, args ...Object) []Object
+}
+
+// call calls fn through ctx and returns its first result, or nil if
+// it returns nothing.
+func call(ctx *Runtime, fn Object, args ...Object) Object {
+	rets := ctx.Call(fn, args...)
+	if len(rets) == 0 || rets[0] == nil {
+		return Nil
+	}
+	return rets[0]
 }
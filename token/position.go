@@ -0,0 +1,181 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// NoPos is the zero Pos; it carries no position information.
+const NoPos Pos = 0
+
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position is a Pos resolved to a file, a byte offset and a 1-based
+// line and column.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+func (pos Position) String() string {
+	s := pos.Filename
+	if pos.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// File maps the positions of a single source file. Its positions
+// are the range [base, base+size].
+type File struct {
+	name  string
+	base  int
+	size  int
+	lines []int
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Base() int {
+	return f.base
+}
+
+func (f *File) Size() int {
+	return f.size
+}
+
+// SetLinesForContent records the offset of the first byte of every
+// line in src.
+func (f *File) SetLinesForContent(src []byte) {
+	lines := []int{0}
+	for i, b := range src {
+		if b == '\n' && i+1 < len(src) {
+			lines = append(lines, i+1)
+		}
+	}
+	f.lines = lines
+}
+
+// SetLines sets the offsets of the first byte of every line, which
+// must start at 0 and increase within the file. It reports whether
+// the lines were accepted.
+func (f *File) SetLines(lines []int) bool {
+	if len(lines) == 0 || lines[0] != 0 {
+		return false
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i] <= lines[i-1] || lines[i] >= f.size {
+			return false
+		}
+	}
+	f.lines = lines
+	return true
+}
+
+// Lines returns the offsets of the first byte of every line.
+func (f *File) Lines() []int {
+	return f.lines
+}
+
+// Pos returns the Pos of the given byte offset in the file.
+func (f *File) Pos(offset int) Pos {
+	if offset < 0 || offset > f.size {
+		panic("illegal file offset")
+	}
+	return Pos(f.base + offset)
+}
+
+// Offset returns the byte offset of p in the file.
+func (f *File) Offset(p Pos) int {
+	if int(p) < f.base || int(p) > f.base+f.size {
+		panic("illegal Pos value")
+	}
+	return int(p) - f.base
+}
+
+func (f *File) Line(p Pos) int {
+	return f.Position(p).Line
+}
+
+func (f *File) Position(p Pos) (pos Position) {
+	if !p.IsValid() {
+		return
+	}
+	offset := f.Offset(p)
+	i := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset }) - 1
+	pos.Filename = f.name
+	pos.Offset = offset
+	if i >= 0 {
+		pos.Line = i + 1
+		pos.Column = offset - f.lines[i] + 1
+	}
+	return
+}
+
+// FileSet hands out disjoint position ranges to the files added to
+// it, so a Pos alone identifies both the file and the offset.
+type FileSet struct {
+	mutex sync.RWMutex
+	base  int
+	files []*File
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile adds a file of the given size to the set. The range of
+// the file starts after the last file added.
+func (s *FileSet) AddFile(name string, size int) *File {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f := &File{name, s.base, size, []int{0}}
+	// +1 so that the end of one file is not the start of the next
+	s.base += size + 1
+	s.files = append(s.files, f)
+	return f
+}
+
+// File returns the file containing p, or nil.
+func (s *FileSet) File(p Pos) *File {
+	if !p.IsValid() {
+		return nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1
+	if i >= 0 {
+		f := s.files[i]
+		if int(p) <= f.base+f.size {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *FileSet) Position(p Pos) (pos Position) {
+	if f := s.File(p); f != nil {
+		pos = f.Position(p)
+	}
+	return
+}
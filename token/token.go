@@ -84,6 +84,7 @@ const (
 	// Keywords
 	BREAK
 	CASE
+	CATCH
 	CHAN
 	CONST
 	CONTINUE
@@ -92,6 +93,7 @@ const (
 	DEFER
 	ELSE
 	FALLTHROUGH
+	FINALLY
 	FOR
 
 	FUNC
@@ -101,6 +103,7 @@ const (
 	IMPORT
 	TRUE
 	FALSE
+	NIL
 
 	INTERFACE
 	MAP
@@ -111,6 +114,7 @@ const (
 	SELECT
 	STRUCT
 	SWITCH
+	TRY
 	TYPE
 	VAR
 	keyword_end
@@ -187,6 +191,7 @@ var Tokens = [...]string{
 
 	BREAK:    "break",
 	CASE:     "case",
+	CATCH:    "catch",
 	CHAN:     "chan",
 	CONST:    "const",
 	CONTINUE: "continue",
@@ -195,6 +200,7 @@ var Tokens = [...]string{
 	DEFER:       "defer",
 	ELSE:        "else",
 	FALLTHROUGH: "fallthrough",
+	FINALLY:     "finally",
 	FOR:         "for",
 
 	FUNC:   "func",
@@ -204,6 +210,7 @@ var Tokens = [...]string{
 	IMPORT: "import",
 	TRUE:   "true",
 	FALSE:  "false",
+	NIL:    "nil",
 
 	INTERFACE: "interface",
 	MAP:       "map",
@@ -214,6 +221,7 @@ var Tokens = [...]string{
 	SELECT: "select",
 	STRUCT: "struct",
 	SWITCH: "switch",
+	TRY:    "try",
 	TYPE:   "type",
 	VAR:    "var",
 }
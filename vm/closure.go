@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/jxwr/doubi/comp/compile"
+	"github.com/jxwr/doubi/rt"
+)
+
+// cell holds a local variable captured by a closure.
+type cell struct {
+	val rt.Object
+}
+
+/// closure
+
+// Closure is a function value of the vm: a proto and the cells of
+// the variables it captured.
+type Closure struct {
+	rt.Property
+
+	Proto  *compile.Proto
+	upvals []*cell
+}
+
+func NewClosure(proto *compile.Proto, upvals []*cell) *Closure {
+	return &Closure{rt.Property(map[string]rt.Object{}), proto, upvals}
+}
+
+func (self *Closure) Name() string {
+	return "function"
+}
+
+func (self *Closure) HashCode() string {
+	return fmt.Sprintf("%p", self)
+}
+
+func (self *Closure) String() string {
+	return self.Proto.Name
+}
+
+func (self *Closure) Dispatch(ctx *rt.Runtime, method string, args ...rt.Object) (results []rt.Object) {
+	var is bool
+	if is, results = self.AccessPropMethod(method, args...); is {
+		return
+	}
+
+	switch method {
+	case "__call__":
+		results = ctx.Call(self, args...)
+	default:
+		rt.NoMethod(self, method, args...)
+	}
+	return
+}
+
+/// iterator
+
+// iterator walks the keys and values of a ranged over collection.
+type iterator struct {
+	keys []rt.Object
+	vals []rt.Object
+	i    int
+}
+
+func newIterator(obj rt.Object) *iterator {
+	it := &iterator{}
+	switch v := obj.(type) {
+	case *rt.ArrayObject:
+		it.vals = v.Vals
+	case *rt.SetObject:
+		it.vals = v.Vals
+	case *rt.StringObject:
+		for _, r := range v.Val {
+			it.vals = append(it.vals, rt.NewRuneObject(r))
+		}
+	case *rt.DictObject:
+		for key, val := range v.Property {
+			it.keys = append(it.keys, rt.NewStringObject(key))
+			it.vals = append(it.vals, val)
+		}
+	default:
+		rt.Raise(rt.TypeError, "cannot range over %s", obj.Name())
+	}
+	return it
+}
+
+// next returns the next key and value, or false when done.
+func (self *iterator) next() (rt.Object, rt.Object, bool) {
+	if self.i >= len(self.vals) {
+		return nil, nil, false
+	}
+	i := self.i
+	self.i++
+	if self.keys != nil {
+		return self.keys[i], self.vals[i], true
+	}
+	return rt.NewIntegerObject(i), self.vals[i], true
+}
+
+func (self *iterator) Name() string {
+	return "iterator"
+}
+
+func (self *iterator) HashCode() string {
+	return fmt.Sprintf("%p", self)
+}
+
+func (self *iterator) String() string {
+	return "#<iterator>"
+}
+
+func (self *iterator) Dispatch(ctx *rt.Runtime, method string, args ...rt.Object) []rt.Object {
+	rt.NoMethod(self, method, args...)
+	return nil
+}
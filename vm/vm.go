@@ -0,0 +1,491 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/jxwr/doubi/comp"
+	"github.com/jxwr/doubi/comp/compile"
+	"github.com/jxwr/doubi/rt"
+	"github.com/jxwr/doubi/token"
+)
+
+// VM runs compiled scripts with the same object semantics as
+// comp.Eval. Every call of a doubi function runs in its own frame,
+// and returns and errors unwind the Go stack along with the frames.
+type VM struct {
+	Fset    *token.FileSet
+	Globals map[string]rt.Object
+	RT      *rt.Runtime
+
+	stack  []rt.Object
+	frames []*frame
+
+	// the results of the last call made for all of its results
+	nres   int
+	callee rt.Object
+}
+
+type frame struct {
+	cl     *Closure
+	pc     int
+	base   int // stack height when the frame was entered
+	locals []rt.Object
+	cells  []*cell // cells of the captured locals
+
+	handlers []handler
+	defers   []deferred
+	saved    []rt.Object // pending return values
+}
+
+// handler is an installed try: where to go and the stack height to
+// restore when an error is raised.
+type handler struct {
+	pc int
+	sp int
+}
+
+type deferred struct {
+	fn   rt.Object
+	args []rt.Object
+}
+
+func New(fset *token.FileSet) *VM {
+	vm := &VM{Fset: fset, Globals: map[string]rt.Object{}}
+	vm.RT = &rt.Runtime{vm.Call}
+	return vm
+}
+
+// Run runs a compiled script. A runtime error stops it and is
+// returned as a *rt.RuntimeError; the globals are kept for the next
+// script.
+func (self *VM) Run(proto *compile.Proto) (err error) {
+	self.frames = self.frames[:0]
+	self.stack = self.stack[:0]
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = self.recoverError(r)
+			self.frames = self.frames[:0]
+			self.stack = self.stack[:0]
+		}
+	}()
+
+	self.call(NewClosure(proto, nil), nil)
+	return nil
+}
+
+// Call calls a function value and returns its results, which are
+// never empty: a call without results gives nil.
+func (self *VM) Call(fn rt.Object, args ...rt.Object) []rt.Object {
+	switch f := fn.(type) {
+	case *Closure:
+		return self.call(f, args)
+	case *rt.FuncObject:
+		if f.Decl == nil {
+			// builtin function or method
+			rets := f.Dispatch(self.RT, "__call__", args...)
+			if len(rets) == 0 {
+				rets = []rt.Object{rt.Nil}
+			}
+			return rets
+		}
+	}
+	rt.Raise(rt.TypeError, "%s is not callable", fn.Name())
+	return nil
+}
+
+func (self *VM) call(cl *Closure, args []rt.Object) []rt.Object {
+	proto := cl.Proto
+	if len(args) != proto.NumParams {
+		rt.Raise(rt.ArgumentError, "%s expects %d argument(s), got %d",
+			proto.Name, proto.NumParams, len(args))
+	}
+	if len(self.frames) >= rt.MaxCallDepth {
+		rt.Raise(rt.RecursionError, "maximum recursion depth exceeded")
+	}
+
+	fr := &frame{cl: cl, base: len(self.stack), locals: make([]rt.Object, len(proto.Locals))}
+	copy(fr.locals, args)
+	for i, captured := range proto.Captured {
+		if captured {
+			if fr.cells == nil {
+				fr.cells = make([]*cell, len(proto.Locals))
+			}
+			fr.cells[i] = &cell{fr.locals[i]}
+		}
+	}
+
+	self.frames = append(self.frames, fr)
+	rets := self.run(fr)
+	self.frames = self.frames[:len(self.frames)-1]
+	return rets
+}
+
+func (self *VM) run(fr *frame) []rt.Object {
+	for {
+		if rets, done := self.exec(fr); done {
+			return rets
+		}
+	}
+}
+
+// recoverError turns a recovered panic into a RuntimeError and, the
+// first time it is seen, attaches the position and the call stack.
+func (self *VM) recoverError(r interface{}) *rt.RuntimeError {
+	err, ok := r.(*rt.RuntimeError)
+	if !ok {
+		err = rt.NewRuntimeError(rt.InternalError, "%v", r)
+	}
+	if err.Stack != nil {
+		return err
+	}
+
+	for i := len(self.frames) - 1; i >= 0; i-- {
+		fr := self.frames[i]
+		pos := self.Fset.Position(fr.pos())
+		if i == len(self.frames)-1 {
+			err.Pos = pos
+		}
+		err.Stack = append(err.Stack, rt.StackFrame{fr.cl.Proto.Name, pos})
+	}
+	return err
+}
+
+// pos is the position of the instruction the frame is running.
+func (fr *frame) pos() token.Pos {
+	if fr.pc == 0 {
+		return token.NoPos
+	}
+	return fr.cl.Proto.Pos[fr.pc-1]
+}
+
+// runDefers runs the calls deferred in fr, the latest first.
+func (self *VM) runDefers(fr *frame) {
+	for len(fr.defers) > 0 {
+		d := fr.defers[len(fr.defers)-1]
+		fr.defers = fr.defers[:len(fr.defers)-1]
+		self.Call(d.fn, d.args...)
+	}
+}
+
+/// stack
+
+func (self *VM) push(obj rt.Object) {
+	self.stack = append(self.stack, obj)
+}
+
+func (self *VM) pop() rt.Object {
+	n := len(self.stack) - 1
+	obj := self.stack[n]
+	self.stack = self.stack[:n]
+	return obj
+}
+
+// popN pops the n values on the top, keeping their order.
+func (self *VM) popN(n int) []rt.Object {
+	top := len(self.stack) - n
+	vals := make([]rt.Object, n)
+	copy(vals, self.stack[top:])
+	self.stack = self.stack[:top]
+	return vals
+}
+
+func undefined(name string) {
+	rt.Raise(rt.NameError, "'%s' is not defined", name)
+}
+
+// fresh copies a constant. Objects carry their own properties, so
+// every evaluation of a literal makes a new one as in comp.Eval.
+func fresh(obj rt.Object) rt.Object {
+	switch v := obj.(type) {
+	case *rt.IntegerObject:
+		return rt.NewIntegerObject(v.Val)
+	case *rt.BigIntObject:
+		return rt.NewBigIntObject(v.Val)
+	case *rt.FloatObject:
+		return rt.NewFloatObject(v.Val)
+	case *rt.ComplexObject:
+		return rt.NewComplexObject(v.Val)
+	case *rt.RuneObject:
+		return rt.NewRuneObject(v.Val)
+	case *rt.StringObject:
+		return rt.NewStringObject(v.Val)
+	}
+	return obj
+}
+
+// methods maps operator tokens to the methods implementing them.
+var methods = func() []string {
+	names := make([]string, len(token.Tokens))
+	for tok, name := range comp.OpFuncs {
+		names[tok] = name
+	}
+	return names
+}()
+
+/// interpreter
+
+// exec runs fr until it returns, or until one of its handlers
+// catches an error, and then the caller runs it again.
+func (self *VM) exec(fr *frame) (rets []rt.Object, done bool) {
+	depth := len(self.frames)
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err := self.recoverError(r)
+		self.frames = self.frames[:depth]
+
+		if n := len(fr.handlers); n > 0 {
+			h := fr.handlers[n-1]
+			fr.handlers = fr.handlers[:n-1]
+			self.stack = self.stack[:h.sp]
+			self.push(rt.NewErrorObject(err))
+			fr.pc = h.pc
+			return
+		}
+
+		self.stack = self.stack[:fr.base]
+		self.runDefers(fr)
+		panic(err)
+	}()
+
+	proto := fr.cl.Proto
+	code := proto.Code
+	for {
+		in := code[fr.pc]
+		fr.pc++
+
+		switch in.Op() {
+		case compile.NOP:
+		case compile.POP:
+			self.stack = self.stack[:len(self.stack)-in.Arg()]
+		case compile.POP_RESULTS:
+			self.stack = self.stack[:len(self.stack)-self.nres]
+
+		case compile.LOAD_CONST:
+			self.push(fresh(proto.Consts[in.Arg()]))
+		case compile.LOAD_NIL:
+			self.push(rt.Nil)
+		case compile.LOAD_TRUE:
+			self.push(rt.NewBoolObject(true))
+		case compile.LOAD_FALSE:
+			self.push(rt.NewBoolObject(false))
+		case compile.LOAD_LOCAL:
+			obj := fr.locals[in.Arg()]
+			if obj == nil {
+				undefined(proto.Locals[in.Arg()])
+			}
+			self.push(obj)
+		case compile.STORE_LOCAL:
+			fr.locals[in.Arg()] = self.pop()
+		case compile.LOAD_CELL:
+			obj := fr.cells[in.Arg()].val
+			if obj == nil {
+				undefined(proto.Locals[in.Arg()])
+			}
+			self.push(obj)
+		case compile.STORE_CELL:
+			fr.cells[in.Arg()].val = self.pop()
+		case compile.FRESH_CELL:
+			fr.cells[in.Arg()] = &cell{}
+		case compile.LOAD_UPVAL:
+			obj := fr.cl.upvals[in.Arg()].val
+			if obj == nil {
+				undefined(proto.Upvals[in.Arg()].Name)
+			}
+			self.push(obj)
+		case compile.STORE_UPVAL:
+			fr.cl.upvals[in.Arg()].val = self.pop()
+		case compile.LOAD_GLOBAL:
+			name := proto.Names[in.Arg()]
+			obj, ok := self.Globals[name]
+			if !ok {
+				if _, ok := rt.Builtins[name]; !ok {
+					undefined(name)
+				}
+				obj = rt.NewFuncObject(name, nil, nil)
+			}
+			self.push(obj)
+		case compile.STORE_GLOBAL:
+			self.Globals[proto.Names[in.Arg()]] = self.pop()
+
+		case compile.GET_PROP:
+			obj := self.pop()
+			prop := rt.NewStringObject(proto.Names[in.Arg()])
+			self.push(obj.Dispatch(self.RT, "__get_property__", prop)[0])
+		case compile.SET_PROP:
+			obj := self.pop()
+			val := self.pop()
+			prop := rt.NewStringObject(proto.Names[in.Arg()])
+			obj.Dispatch(self.RT, "__set_property__", prop, val)
+		case compile.GET_INDEX:
+			idx := self.pop()
+			obj := self.pop()
+			self.push(obj.Dispatch(self.RT, "__get_index__", idx)[0])
+		case compile.SET_INDEX:
+			idx := self.pop()
+			obj := self.pop()
+			val := self.pop()
+			obj.Dispatch(self.RT, "__set_index__", idx, val)
+		case compile.SLICE:
+			var low, high rt.Object
+			if in.Arg()&2 != 0 {
+				high = self.pop()
+			}
+			if in.Arg()&1 != 0 {
+				low = self.pop()
+			}
+			obj := self.pop()
+			self.push(obj.Dispatch(self.RT, "__slice__", low, high)[0])
+
+		case compile.UNARY:
+			switch obj := self.pop().(type) {
+			case *rt.IntegerObject:
+				self.push(obj.Neg())
+			case *rt.BigIntObject:
+				self.push(obj.Neg())
+			case *rt.FloatObject:
+				self.push(rt.NewFloatObject(-obj.Val))
+			default:
+				rt.Raise(rt.TypeError, "unsupported operation: %s%s", token.Tokens[in.Arg()], obj.Name())
+			}
+		case compile.BINARY:
+			robj := self.pop()
+			lobj := self.pop()
+			op := token.Token(in.Arg())
+			// any value can be compared with nil
+			if robj == rt.Nil && (op == token.EQL || op == token.NEQ) {
+				lobj, robj = robj, lobj
+			}
+			self.push(lobj.Dispatch(self.RT, methods[op], robj)[0])
+		case compile.INPLACE:
+			obj := self.pop()
+			val := self.pop()
+			self.push(rt.Inplace(self.RT, obj, methods[in.Arg()], val))
+		case compile.INC:
+			self.push(rt.Inplace(self.RT, self.pop(), "__inc__"))
+		case compile.DEC:
+			self.push(rt.Inplace(self.RT, self.pop(), "__dec__"))
+
+		case compile.ARRAY:
+			self.push(rt.NewArrayObject(self.popN(in.Arg())))
+		case compile.SET:
+			self.push(rt.NewSetObject(self.popN(in.Arg())))
+		case compile.DICT:
+			vals := self.popN(2 * in.Arg())
+			fields := map[string]rt.Object{}
+			for i := 0; i < len(vals); i += 2 {
+				fields[vals[i].HashCode()] = vals[i+1]
+			}
+			self.push(rt.NewDictObject(&fields))
+		case compile.CLOSURE:
+			p := proto.Protos[in.Arg()]
+			upvals := make([]*cell, len(p.Upvals))
+			for i, up := range p.Upvals {
+				if up.Local {
+					upvals[i] = fr.cells[up.Index]
+				} else {
+					upvals[i] = fr.cl.upvals[up.Index]
+				}
+			}
+			self.push(NewClosure(p, upvals))
+
+		case compile.CALL:
+			n := in.A()
+			if n == compile.Multi {
+				n = self.nres
+			}
+			args := self.popN(n)
+			fn := self.pop()
+			rets := self.Call(fn, args...)
+			if in.B() == compile.Multi {
+				self.stack = append(self.stack, rets...)
+				self.nres, self.callee = len(rets), fn
+			} else {
+				if len(rets) != 1 {
+					rt.Raise(rt.ValueError, "multiple-value %s() (%d values) in single-value context",
+						fn.String(), len(rets))
+				}
+				self.push(rets[0])
+			}
+		case compile.RESULTS:
+			self.nres, self.callee = in.Arg(), nil
+		case compile.UNPACK:
+			if self.nres != in.Arg() {
+				if self.callee == nil {
+					rt.Raise(rt.ValueError, "assignment mismatch: %d variable(s) but %d value(s)",
+						in.Arg(), self.nres)
+				}
+				rt.Raise(rt.ValueError, "assignment mismatch: %d variable(s) but %s() returns %d value(s)",
+					in.Arg(), self.callee.String(), self.nres)
+			}
+		case compile.RETURN, compile.RETURN_RESULTS:
+			n := in.Arg()
+			if in.Op() == compile.RETURN_RESULTS {
+				n = self.nres
+			}
+			rets = self.popN(n)
+			if n == 0 {
+				rets = []rt.Object{rt.Nil}
+			}
+			self.stack = self.stack[:fr.base]
+			self.runDefers(fr)
+			return rets, true
+		case compile.SAVE_RESULTS:
+			n := in.Arg()
+			if n == compile.Multi {
+				n = self.nres
+			}
+			fr.saved = self.popN(n)
+		case compile.RETURN_SAVED:
+			rets = fr.saved
+			if len(rets) == 0 {
+				rets = []rt.Object{rt.Nil}
+			}
+			self.stack = self.stack[:fr.base]
+			self.runDefers(fr)
+			return rets, true
+		case compile.DEFER:
+			n := in.Arg()
+			if n == compile.Multi {
+				n = self.nres
+			}
+			args := self.popN(n)
+			fn := self.pop()
+			fr.defers = append(fr.defers, deferred{fn, args})
+
+		case compile.JUMP:
+			fr.pc = in.Arg()
+		case compile.JUMP_IF_FALSE:
+			obj := self.pop()
+			cond, ok := obj.(*rt.BoolObject)
+			if !ok {
+				rt.Raise(rt.TypeError, "non-bool %s used as condition", obj.Name())
+			}
+			if !cond.Val {
+				fr.pc = in.Arg()
+			}
+		case compile.ITER:
+			fr.locals[in.Arg()] = newIterator(self.pop())
+		case compile.FOR_ITER:
+			key, val, ok := fr.locals[in.Arg()].(*iterator).next()
+			if ok {
+				self.push(key)
+				self.push(val)
+			}
+			self.push(rt.NewBoolObject(ok))
+		case compile.TRY:
+			fr.handlers = append(fr.handlers, handler{in.Arg(), len(self.stack)})
+		case compile.END_TRY:
+			fr.handlers = fr.handlers[:len(fr.handlers)-1]
+		case compile.RERAISE:
+			panic(self.pop().(*rt.ErrorObject).Err)
+
+		default:
+			panic(fmt.Sprintf("unknown instruction %s", in.Op()))
+		}
+	}
+}